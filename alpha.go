@@ -0,0 +1,79 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/fs"
+
+	"github.com/disintegration/imaging"
+)
+
+// mayHaveAlpha returns whether the color model of the image at path can hold
+// transparent pixels, which only requires reading its header.
+func mayHaveAlpha(fsys fs.FS, path string) bool {
+	cfg, err := decodeConfig(fsys, path)
+	if err != nil {
+		return true
+	}
+
+	switch model := cfg.ColorModel.(type) {
+	case color.Palette:
+		for _, c := range model {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch cfg.ColorModel {
+	case color.YCbCrModel, color.GrayModel, color.Gray16Model, color.CMYKModel:
+		return false
+	}
+	return true
+}
+
+// isOpaque returns whether every pixel of img is fully opaque.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if alphaAt(img, x, y) != 0xff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// losslessSizes returns sizes with webp outputs made lossless. The other
+// formats are left as they are, marking them too keeps sizes that only differ
+// in format comparable for -pickSmallest.
+func losslessSizes(sizes []Size) []Size {
+	lossless := make([]Size, len(sizes))
+	for i, s := range sizes {
+		s.Lossless = true
+		lossless[i] = s
+	}
+	return lossless
+}
+
+// flatten returns img drawn over -background, or white if it isn't set or isn't
+// opaque, for formats that can't store transparency. Opaque images are
+// returned as they are.
+func flatten(img image.Image) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+
+	bg := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	if c, ok := backgroundColor.(color.NRGBA); ok && c.A == 0xff {
+		bg = c
+	}
+
+	return imaging.Overlay(imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), bg), img, image.Point{}, 1)
+}
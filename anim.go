@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Frames of animated images that -animFrame can pick.
+const (
+	animFirst          = "first"
+	animMiddle         = "middle"
+	animLast           = "last"
+	animRepresentative = "representative"
+)
+
+// representativeSampleSize is the size frames are downsampled to when looking
+// for the most representative one.
+const representativeSampleSize = 32
+
+func isGIF(br *bufio.Reader) bool {
+	magic, _ := br.Peek(6)
+	return string(magic) == "GIF87a" || string(magic) == "GIF89a"
+}
+
+// decodeGIFFrame decodes the frame of the GIF in r picked by which, as it's
+// shown when the animation is played.
+func decodeGIFFrame(r io.Reader, which string) (image.Image, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, fmt.Errorf("gif has no frames")
+	}
+
+	index := 0
+	switch which {
+	case animMiddle:
+		index = len(g.Image) / 2
+	case animLast:
+		index = len(g.Image) - 1
+	case animRepresentative:
+		index = representativeFrame(g)
+	}
+
+	var frame image.Image
+	composeGIF(g, func(i int, canvas *image.NRGBA) bool {
+		if i == index {
+			frame = imaging.Clone(canvas)
+			return false
+		}
+		return true
+	})
+
+	return frame, nil
+}
+
+// composeGIF draws the frames of g one after another on a canvas following their
+// disposal methods, calling visit with the canvas as shown for every frame until
+// it returns false.
+func composeGIF(g *gif.GIF, visit func(i int, canvas *image.NRGBA) bool) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, f := range g.Image {
+		bounds = bounds.Union(f.Bounds())
+	}
+
+	canvas := image.NewNRGBA(bounds)
+
+	for i, f := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, f.Bounds(), f, f.Bounds().Min, draw.Over)
+
+		if !visit(i, canvas) {
+			return
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, f.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			draw.Draw(canvas, canvas.Bounds(), previous, previous.Bounds().Min, draw.Src)
+		}
+	}
+}
+
+// representativeFrame returns the index of the frame of g closest to the average
+// of all of them.
+func representativeFrame(g *gif.GIF) int {
+	var samples [][]uint8
+	composeGIF(g, func(i int, canvas *image.NRGBA) bool {
+		samples = append(samples, imaging.Resize(canvas, representativeSampleSize, representativeSampleSize, imaging.Box).Pix)
+		return true
+	})
+
+	mean := make([]float64, len(samples[0]))
+	for _, s := range samples {
+		for j, v := range s {
+			mean[j] += float64(v) / float64(len(samples))
+		}
+	}
+
+	best, bestDist := 0, math.Inf(1)
+	for i, s := range samples {
+		var dist float64
+		for j, v := range s {
+			d := float64(v) - mean[j]
+			dist += d * d
+		}
+
+		if dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+
+	return best
+}
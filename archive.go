@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveFS is an OutputFS that stores every file as an entry of a zip or tar
+// archive. Files are buffered in memory until closed since archive writers
+// can only write one entry at a time.
+type archiveFS struct {
+	mu  sync.Mutex
+	f   *os.File
+	gz  *gzip.Writer
+	zip *zip.Writer
+	tar *tar.Writer
+}
+
+// newArchiveFS creates the archive at path, its format is picked from the
+// extension: .zip, .tar or .tar.gz/.tgz.
+func newArchiveFS(path string) (*archiveFS, error) {
+	lower := strings.ToLower(path)
+	if !strings.HasSuffix(lower, ".zip") && !strings.HasSuffix(lower, ".tar") &&
+		!strings.HasSuffix(lower, ".tar.gz") && !strings.HasSuffix(lower, ".tgz") {
+		return nil, fmt.Errorf("unknown archive format for %s, must be .zip, .tar, .tar.gz or .tgz", path)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+
+	a := &archiveFS{f: f}
+
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		a.zip = zip.NewWriter(f)
+	case strings.HasSuffix(lower, ".tar"):
+		a.tar = tar.NewWriter(f)
+	default:
+		a.gz = gzip.NewWriter(f)
+		a.tar = tar.NewWriter(a.gz)
+	}
+
+	return a, nil
+}
+
+func (a *archiveFS) Create(path string) (io.WriteCloser, error) {
+	name, err := archiveEntryName(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &archiveEntry{fs: a, name: name}, nil
+}
+
+// Stat always reports that the file doesn't exist, the archive is written from
+// scratch on every run.
+func (a *archiveFS) Stat(path string) (fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+}
+
+func (a *archiveFS) add(name string, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.zip != nil {
+		w, err := a.zip.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store, // Images are already compressed
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		return err
+	}
+
+	err := a.tar.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = a.tar.Write(data)
+	return err
+}
+
+// Close finishes writing the archive.
+func (a *archiveFS) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var err error
+	if a.zip != nil {
+		err = a.zip.Close()
+	} else {
+		err = a.tar.Close()
+		if a.gz != nil && err == nil {
+			err = a.gz.Close()
+		}
+	}
+
+	if err != nil {
+		a.f.Close()
+		return err
+	}
+	return a.f.Close()
+}
+
+// archiveEntryName returns the name of the entry for the output at path, which
+// is relative to -outDir if it's inside of it.
+func archiveEntryName(path string) (string, error) {
+	name := filepath.Clean(path)
+
+	if *outFolder != "" {
+		if rel, err := filepath.Rel(*outFolder, path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+	}
+
+	name = strings.TrimPrefix(filepath.ToSlash(name), "/")
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("output %s is outside of the current folder and can't be stored in the archive", path)
+	}
+
+	return name, nil
+}
+
+type archiveEntry struct {
+	fs   *archiveFS
+	name string
+	buf  bytes.Buffer
+
+	closed bool
+}
+
+func (e *archiveEntry) Write(p []byte) (int, error) {
+	return e.buf.Write(p)
+}
+
+func (e *archiveEntry) Close() error {
+	if e.closed {
+		return os.ErrClosed
+	}
+	e.closed = true
+
+	if err := e.fs.add(e.name, e.buf.Bytes()); err != nil {
+		return fmt.Errorf("add %s to archive: %w", e.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// Sprite is where an image was packed in a sprite sheet.
+type Sprite struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// AtlasMap is the JSON map written next to a sprite sheet, with the sprites by
+// the name of their file without extension.
+type AtlasMap struct {
+	Image   string            `json:"image"`
+	Width   int               `json:"width"`
+	Height  int               `json:"height"`
+	Sprites map[string]Sprite `json:"sprites"`
+}
+
+// writeAtlas packs every file into a single sprite sheet written to path, and
+// writes where each sprite is to a .json or .css file next to it.
+func writeAtlas(files []string, path string) error {
+	if *atlasPadding < 0 || *atlasMaxSize <= 0 || *atlasSpriteSize < 0 {
+		return fmt.Errorf("padding and sprite size can't be negative and max size must be positive")
+	}
+	if *atlasMap != "json" && *atlasMap != "css" {
+		return fmt.Errorf("invalid map format %s, expected json or css", *atlasMap)
+	}
+
+	names := make([]string, len(files))
+	seen := make(map[string]string)
+	for i, f := range files {
+		names[i] = strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		if other, ok := seen[names[i]]; ok {
+			return fmt.Errorf("%s and %s would both be named %s", other, f, names[i])
+		}
+		seen[names[i]] = f
+	}
+
+	imgs := make([]image.Image, len(files))
+
+	var g errgroup.Group
+	sem := semaphore.NewWeighted(int64(*parallel))
+	for i, f := range files {
+		i, f := i, f
+
+		g.Go(func() error {
+			sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			img, err := loadSprite(f)
+			imgs[i] = img
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	rects, w, h, err := packShelves(imgs, *atlasPadding, *atlasMaxSize)
+	if err != nil {
+		return err
+	}
+
+	sheet := imaging.New(w, h, color.Transparent)
+	for i, img := range imgs {
+		draw.Draw(sheet, rects[i], img, img.Bounds().Min, draw.Src)
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+
+	out, err := outFS.Create(path)
+	if err != nil {
+		return fmt.Errorf("create file %s: %w", path, err)
+	}
+	if err := encode(out, sheet, Size{Format: format}, *quality); err != nil {
+		out.Close()
+		return fmt.Errorf("encode file %s: %w", path, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("write file %s: %w", path, err)
+	}
+
+	sprites := make(map[string]Sprite, len(files))
+	for i, r := range rects {
+		sprites[names[i]] = Sprite{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()}
+	}
+
+	mapPath := strings.TrimSuffix(path, filepath.Ext(path)) + "." + *atlasMap
+
+	var data []byte
+	if *atlasMap == "css" {
+		data = atlasCSS(filepath.Base(path), names, sprites)
+	} else {
+		data, err = json.MarshalIndent(AtlasMap{
+			Image:   filepath.Base(path),
+			Width:   w,
+			Height:  h,
+			Sprites: sprites,
+		}, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode map: %w", err)
+		}
+	}
+	if err := writeOutputFile(mapPath, data); err != nil {
+		return fmt.Errorf("write file %s: %w", mapPath, err)
+	}
+
+	if !*quiet {
+		log.Printf("packed %d sprites into %s (%dx%d)", len(files), path, w, h)
+	}
+	return nil
+}
+
+// loadSprite decodes the image at path, fitting it within -atlasSpriteSize if set.
+func loadSprite(path string) (image.Image, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer in.Close()
+
+	img, err := decodeSource(in, path)
+	if err != nil {
+		return nil, fmt.Errorf("decode image %s: %w", path, err)
+	}
+	img = prepareSource(img)
+
+	if *atlasSpriteSize > 0 {
+		img = imaging.Fit(img, *atlasSpriteSize, *atlasSpriteSize, imaging.Lanczos)
+	}
+	return img, nil
+}
+
+// packShelves places imgs in rows from the tallest to the shortest, starting a
+// new row when the next one doesn't fit in the width. The width starts from that
+// of a square holding all of them and grows until the sheet is no taller than
+// wide, up to maxSize. It returns where each image goes and the size of the sheet.
+func packShelves(imgs []image.Image, padding, maxSize int) ([]image.Rectangle, int, int, error) {
+	order := make([]int, len(imgs))
+	widest, narrowest, area := 0, maxSize, 0
+	for i, img := range imgs {
+		order[i] = i
+		b := img.Bounds()
+		widest = maxInt(widest, b.Dx())
+		narrowest = minInt(narrowest, b.Dx())
+		area += (b.Dx() + padding) * (b.Dy() + padding)
+	}
+	if widest > maxSize {
+		return nil, 0, 0, fmt.Errorf("a sprite is %d pixels wide, wider than the max size of %d", widest, maxSize)
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return imgs[order[i]].Bounds().Dy() > imgs[order[j]].Bounds().Dy()
+	})
+
+	width := minInt(maxSize, maxInt(widest, int(math.Ceil(math.Sqrt(float64(area))))))
+	for {
+		rects, w, h := shelve(imgs, order, padding, width)
+		if h <= width || width == maxSize {
+			if h > maxSize {
+				return nil, 0, 0, fmt.Errorf("the sprites don't fit in a %dx%d sheet", maxSize, maxSize)
+			}
+			return rects, w, h, nil
+		}
+
+		width = minInt(maxSize, width+maxInt(1, narrowest+padding))
+	}
+}
+
+// shelve places imgs in rows no wider than width in the given order, returning
+// where each image goes and the size they take up.
+func shelve(imgs []image.Image, order []int, padding, width int) ([]image.Rectangle, int, int) {
+	rects := make([]image.Rectangle, len(imgs))
+	x, y, shelf, used := 0, 0, 0, 0
+	for _, i := range order {
+		b := imgs[i].Bounds()
+		if x > 0 && x+b.Dx() > width {
+			x, y, shelf = 0, y+shelf+padding, 0
+		}
+
+		rects[i] = image.Rect(x, y, x+b.Dx(), y+b.Dy())
+		x += b.Dx() + padding
+		shelf = maxInt(shelf, b.Dy())
+		used = maxInt(used, rects[i].Max.X)
+	}
+
+	return rects, used, y + shelf
+}
+
+// atlasCSS returns a rule per sprite with -cssSelector that shows it as the
+// background of an element of its size.
+func atlasCSS(sheet string, names []string, sprites map[string]Sprite) []byte {
+	var b strings.Builder
+	for _, name := range names {
+		s := sprites[name]
+
+		fmt.Fprintf(&b, "%s {\n", strings.ReplaceAll(*cssSelector, "{name}", name))
+		fmt.Fprintf(&b, "  background: url(%s) no-repeat %s %s;\n", strconv.Quote(sheet), cssOffset(s.X), cssOffset(s.Y))
+		fmt.Fprintf(&b, "  width: %dpx;\n", s.Width)
+		fmt.Fprintf(&b, "  height: %dpx;\n", s.Height)
+		b.WriteString("}\n")
+	}
+	return []byte(b.String())
+}
+
+// cssOffset returns the background position that moves a sprite at n to the
+// origin of the element.
+func cssOffset(n int) string {
+	if n == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("-%dpx", n)
+}
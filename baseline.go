@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	baselineHash = "hash"
+	baselineSSIM = "ssim"
+)
+
+// compareBaseline compares every output with the file at the same path relative
+// to the output folder in the baseline folder, returning the number of outputs
+// that are missing from it or differ from it. With the ssim mode outputs differ
+// if their SSIM against the baseline is under minSSIM, otherwise if their
+// contents aren't identical.
+func compareBaseline(baseline, mode string, minSSIM float64, outputs []Output) (int, error) {
+	root := *outFolder
+	if root == "" {
+		root = "."
+	}
+
+	diffs := 0
+
+	for _, o := range outputs {
+		rel, err := filepath.Rel(root, o.Path)
+		if err != nil {
+			return diffs, fmt.Errorf("resolve path %s: %w", o.Path, err)
+		}
+		other := filepath.Join(baseline, rel)
+
+		if _, err := os.Stat(other); os.IsNotExist(err) {
+			log.Printf("output %s is missing from the baseline", o.Path)
+			diffs++
+			continue
+		}
+
+		same, err := sameAsBaseline(o.Path, other, mode, minSSIM)
+		if err != nil {
+			return diffs, err
+		}
+		if !same {
+			diffs++
+		}
+	}
+
+	return diffs, nil
+}
+
+func sameAsBaseline(path, other, mode string, minSSIM float64) (bool, error) {
+	if mode == baselineHash {
+		a, err := hashFile(path)
+		if err != nil {
+			return false, fmt.Errorf("hash file %s: %w", path, err)
+		}
+		b, err := hashFile(other)
+		if err != nil {
+			return false, fmt.Errorf("hash file %s: %w", other, err)
+		}
+
+		if a != b {
+			log.Printf("output %s differs from %s", path, other)
+		}
+		return a == b, nil
+	}
+
+	a, err := decodeFile(path)
+	if err != nil {
+		return false, err
+	}
+	b, err := decodeFile(other)
+	if err != nil {
+		return false, err
+	}
+
+	if a.Bounds().Size() != b.Bounds().Size() {
+		log.Printf("output %s is %dx%d but %s is %dx%d", path, a.Bounds().Dx(), a.Bounds().Dy(), other, b.Bounds().Dx(), b.Bounds().Dy())
+		return false, nil
+	}
+
+	if s := ssim(a, b); s < minSSIM {
+		log.Printf("output %s has an SSIM of %.4f against %s", path, s, other)
+		return false, nil
+	}
+	return true, nil
+}
+
+func decodeFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decode image %s: %w", path, err)
+	}
+
+	return img, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// benchmarkRuns is how many times each filter resizes the image, the fastest
+// run is reported to reduce noise.
+const benchmarkRuns = 3
+
+// benchmarkFilters resizes the image at path to size with every resampling
+// filter and prints a table with how long the resize took, the size of the
+// output once encoded and its SSIM against the output of lanczos, the default
+// filter for upscaling and small reductions.
+func benchmarkFilters(path string, size Size) error {
+	f, err := osFS{}.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	img, err := decodeSource(f, path)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("decode image: %w", err)
+	}
+	img = prepareSource(img)
+
+	w, h := size.Dimensions(img.Bounds().Dx(), img.Bounds().Dy())
+
+	names := make([]string, 0, len(resampleFilters))
+	for name := range resampleFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// resizeToSize picks the filter from the flags, which aren't read anywhere
+	// else while benchmarking
+	resizeWith := func(name string) image.Image {
+		*downscaleFilter, *upscaleFilter = name, name
+		return resizeToSize(img, size, w, h)
+	}
+
+	reference := resizeWith("lanczos")
+
+	fmt.Printf("resizing %s from %dx%d to %dx%d encoded to %s\n\n", path, img.Bounds().Dx(), img.Bounds().Dy(), w, h, size.Format)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILTER\tRESIZE\tBYTES\tSSIM")
+
+	for _, name := range names {
+		var out image.Image
+		var best time.Duration
+		for i := 0; i < benchmarkRuns; i++ {
+			start := time.Now()
+			out = resizeWith(name)
+			if d := time.Since(start); i == 0 || d < best {
+				best = d
+			}
+		}
+
+		cw := &countingWriter{w: io.Discard}
+		if err := encode(cw, out, size, *quality); err != nil {
+			return fmt.Errorf("encode image with filter %s: %w", name, err)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.4f\n", name, best.Round(time.Microsecond), cw.n, ssim(reference, out))
+	}
+
+	return tw.Flush()
+}
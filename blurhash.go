@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// blurHashSampleSize is the size images are downsampled to before computing their
+// BlurHash, it only encodes very low frequencies so more detail is wasted work.
+const blurHashSampleSize = 64
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash computes the BlurHash (https://blurha.sh) of img with the given
+// number of horizontal and vertical components.
+func blurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("components must be between 1 and 9")
+	}
+
+	small := imaging.Fit(img, blurHashSampleSize, blurHashSampleSize, imaging.Box)
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var f [3]float64
+
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+
+					p := small.Pix[small.PixOffset(x, y):]
+					for c := 0; c < 3; c++ {
+						f[c] += basis * srgbToLinear(p[c])
+					}
+				}
+			}
+
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			for c := 0; c < 3; c++ {
+				f[c] *= scale
+			}
+
+			factors = append(factors, f)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+
+	maxValue := 1.0
+	if len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			for c := 0; c < 3; c++ {
+				actualMax = math.Max(actualMax, math.Abs(f[c]))
+			}
+		}
+
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encodeBase83(0, 1))
+	}
+
+	sb.WriteString(encodeBase83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+
+	for _, f := range ac {
+		var q [3]int
+		for c := 0; c < 3; c++ {
+			q[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(f[c]/maxValue, 0.5)*9+9.5))))
+		}
+
+		sb.WriteString(encodeBase83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+
+	return sb.String(), nil
+}
+
+func encodeBase83(value, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(b)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"image"
+	"io"
+)
+
+// fitByteBudget sets the quality of the lossy jobs of the image at path to the
+// highest one for which the outputs of all its jobs add up to at most budget
+// bytes, counting fixed bytes of outputs that aren't regenerated. Every lossy
+// job gets the same quality so that no variant is much worse than the others.
+// The images rendered for the search are kept in the jobs, which encode them
+// instead of rendering them again.
+func fitByteBudget(path string, jobs []*Job, budget, fixed int64) error {
+	var lossy []*Job
+	var imgs []image.Image
+
+	for _, job := range jobs {
+		img := renderJob(job)
+		job.rendered = img
+
+		if !isLossy(job.size) {
+			cw := &countingWriter{w: io.Discard}
+			if err := encode(cw, img, job.size, *quality); err != nil {
+				return err
+			}
+			fixed += cw.n
+			continue
+		}
+
+		lossy = append(lossy, job)
+		imgs = append(imgs, img)
+	}
+
+	if len(lossy) == 0 {
+		return nil
+	}
+
+	fitsAny := false
+	q, err := bisectQuality(func(q float64) (bool, error) {
+		total := fixed
+		for i, job := range lossy {
+			cw := &countingWriter{w: io.Discard}
+			if err := encode(cw, imgs[i], job.size, q); err != nil {
+				return false, err
+			}
+			total += cw.n
+		}
+
+		fitsAny = fitsAny || total <= budget
+		return total <= budget, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !fitsAny {
+		logImage(path, "warning: the variants of %s don't fit in the byte budget even at quality %g", path, q)
+	} else if !*quiet {
+		logImage(path, "using quality %g for the variants of %s to fit the byte budget", q, path)
+	}
+
+	for _, job := range lossy {
+		job.quality, job.hasQuality = q, true
+	}
+	return nil
+}
+
+// renderJob resizes the image of job and runs the pipeline steps after resizing
+// on it the way doJob does. The resized image is kept in job.resized.
+func renderJob(job *Job) image.Image {
+	img := job.img
+	if job.size.Name() != "" {
+		w, h := job.dimensions()
+		if job.svg != nil {
+			img = job.svg.rasterizeForSize(job.size, img.Bounds().Dx(), img.Bounds().Dy(), w, h)
+		}
+		img = resizeToSize(img, job.size, w, h)
+	}
+	job.resized = img
+
+	return finishOutput(img, job.size)
+}
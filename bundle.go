@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// lqipSize is the maximum width and height of the low quality image placeholders
+// included in frontend bundles.
+const lqipSize = 16
+
+// FrontendBundle describes a source image and its variants for use by a frontend
+// lazy loader. Fields not listed in -frontendFields are left out.
+type FrontendBundle struct {
+	Source   string          `json:"source"`
+	Width    int             `json:"width,omitempty"`
+	Height   int             `json:"height,omitempty"`
+	LQIP     string          `json:"lqip,omitempty"`
+	Color    string          `json:"color,omitempty"`
+	BlurHash string          `json:"blurhash,omitempty"`
+	Variants []BundleVariant `json:"variants,omitempty"`
+}
+
+type BundleVariant struct {
+	URL    string `json:"url"`
+	Type   string `json:"type"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+var bundleFieldNames = []string{"dimensions", "lqip", "color", "blurhash", "variants"}
+
+// bundleFields is the set of fields parsed from -frontendFields.
+var bundleFields = make(map[string]bool)
+
+func parseBundleFields(list string) error {
+	for _, f := range strings.Split(list, ",") {
+		valid := false
+		for _, name := range bundleFieldNames {
+			valid = valid || f == name
+		}
+		if !valid {
+			return fmt.Errorf("unknown field %s, must be one of %s", f, strings.Join(bundleFieldNames, ", "))
+		}
+
+		bundleFields[f] = true
+	}
+
+	return nil
+}
+
+// bundleWants returns whether the frontend bundle includes field.
+func bundleWants(field string) bool {
+	return *frontendBundle && bundleFields[field]
+}
+
+// lqipDataURI returns a tiny blurry JPEG version of img as a data URI.
+func lqipDataURI(img image.Image) (string, error) {
+	thumb := imaging.Fit(img, lqipSize, lqipSize, imaging.Box)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 40}); err != nil {
+		return "", err
+	}
+
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// writeFrontendBundles writes <name>.bundle.json next to the outputs of every
+// source that produced any in this run.
+func writeFrontendBundles(infos *SourceInfos, outputs []Output) error {
+	bySource := make(map[string][]Output)
+	var order []string
+
+	for _, o := range outputs {
+		if _, ok := bySource[o.Source]; !ok {
+			order = append(order, o.Source)
+		}
+		bySource[o.Source] = append(bySource[o.Source], o)
+	}
+
+	for _, source := range order {
+		base, err := outputBase(source, "")
+		if err != nil {
+			return err
+		}
+		path := base + ".bundle.json"
+
+		bundle := FrontendBundle{Source: filepath.ToSlash(source)}
+
+		if info := infos.Get(source); info != nil {
+			if bundleFields["dimensions"] {
+				bundle.Width, bundle.Height = info.Width, info.Height
+			}
+			bundle.LQIP = info.LQIP
+			bundle.Color = info.Color
+			bundle.BlurHash = info.BlurHash
+		}
+
+		if bundleFields["variants"] {
+			for _, o := range bySource[source] {
+				rel, err := filepath.Rel(filepath.Dir(path), o.Path)
+				if err != nil {
+					rel = o.Path
+				}
+
+				bundle.Variants = append(bundle.Variants, BundleVariant{
+					URL:    filepath.ToSlash(rel),
+					Type:   mimeType(o.Format),
+					Width:  o.Width,
+					Height: o.Height,
+				})
+			}
+		}
+
+		data, err := json.MarshalIndent(bundle, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeOutputFile(path, data); err != nil {
+			return fmt.Errorf("write bundle of %s: %w", source, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// caseInsensitiveDirs caches whether each folder is on a case-insensitive file
+// system, by absolute path.
+var caseInsensitiveDirs sync.Map
+
+// caseInsensitive returns whether names in dir are case-insensitive, like on the
+// default file systems of macOS and Windows. It's detected by looking up the
+// closest folder up from dir that exists, since dir may not have been created
+// yet, with the case of its name swapped: on a case-insensitive file system
+// both names are the same folder.
+func caseInsensitive(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if v, ok := caseInsensitiveDirs.Load(abs); ok {
+		return v.(bool)
+	}
+
+	insensitive := false
+	for d := abs; ; d = filepath.Dir(d) {
+		fi, err := os.Stat(d)
+		name := filepath.Base(d)
+		swapped := swapCase(name)
+
+		if err == nil && swapped != name {
+			sfi, err := os.Stat(filepath.Join(filepath.Dir(d), swapped))
+			insensitive = err == nil && os.SameFile(fi, sfi)
+			break
+		}
+
+		// Either it doesn't exist or its name has no letters, try its parent
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	caseInsensitiveDirs.Store(abs, insensitive)
+	return insensitive
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
+
+// pathKey returns a key that is the same for every spelling of path that refers
+// to the same file, for comparing paths that may not exist yet.
+func pathKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if caseInsensitive(filepath.Dir(path)) {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// uniqueFiles returns files without the ones that were already listed under the
+// same or another spelling, like photo.JPG and photo.jpg on a case-insensitive
+// file system.
+func uniqueFiles(files []string) []string {
+	seen := make(map[string]string)
+
+	unique := files[:0]
+	for _, f := range files {
+		key := pathKey(f)
+		if first, ok := seen[key]; ok {
+			if !*quiet && first != f {
+				log.Printf("skipping %s, it's the same file as %s", f, first)
+			}
+			continue
+		}
+
+		seen[key] = f
+		unique = append(unique, f)
+	}
+	return unique
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+var channelNames = [4]string{"r", "g", "b", "a"}
+
+// writeChannels writes a grayscale PNG of each of the red, green, blue and alpha
+// channels of every file, meant for troubleshooting color issues.
+func writeChannels(files []string) error {
+	var g errgroup.Group
+	sem := semaphore.NewWeighted(int64(*parallel))
+
+	for _, f := range files {
+		f := f
+
+		g.Go(func() error {
+			sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			return writeImageChannels(f)
+		})
+	}
+
+	return g.Wait()
+}
+
+func writeImageChannels(path string) error {
+	img, err := imaging.Open(path)
+	if err != nil {
+		return fmt.Errorf("open image %s: %w", path, err)
+	}
+
+	base, err := outputBase(path, "")
+	if err != nil {
+		return err
+	}
+
+	// Straight (non premultiplied) alpha, the channels are stored as they are in NRGBA
+	nrgba := imaging.Clone(img)
+
+	for c, name := range channelNames {
+		gray := image.NewGray(nrgba.Bounds())
+		for i := range gray.Pix {
+			gray.Pix[i] = nrgba.Pix[i*4+c]
+		}
+
+		outPath := fmt.Sprintf("%s.channel-%s.png", base, name)
+
+		out, err := outFS.Create(outPath)
+		if err != nil {
+			return fmt.Errorf("create file %s: %w", outPath, err)
+		}
+		if err := png.Encode(out, gray); err != nil {
+			out.Close()
+			return fmt.Errorf("encode file %s: %w", outPath, err)
+		}
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("write file %s: %w", outPath, err)
+		}
+	}
+
+	if !*quiet {
+		log.Printf("wrote channels of %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// colorSampleSize is the size images are downsampled to before computing their color.
+const colorSampleSize = 64
+
+// dominantBits is the number of bits per channel colors are quantized to when
+// looking for the dominant color, resulting in 2^(3*dominantBits) cells.
+const dominantBits = 4
+
+// placeholderColor returns the average or dominant color of img as a hex string.
+func placeholderColor(img image.Image, mode string) string {
+	small := imaging.Fit(img, colorSampleSize, colorSampleSize, imaging.Box)
+
+	var pixels [][3]uint8
+	for i := 0; i < len(small.Pix); i += 4 {
+		// Ignore mostly transparent pixels, their color isn't visible
+		if small.Pix[i+3] < 128 {
+			continue
+		}
+		pixels = append(pixels, [3]uint8{small.Pix[i], small.Pix[i+1], small.Pix[i+2]})
+	}
+	if len(pixels) == 0 {
+		return ""
+	}
+
+	if mode == "dominant" {
+		pixels = dominantCell(pixels)
+	}
+
+	c := averageColor(pixels)
+	return fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2])
+}
+
+// dominantCell quantizes the colors of pixels to dominantBits per channel and
+// returns the pixels of the most frequent quantized color.
+func dominantCell(pixels [][3]uint8) [][3]uint8 {
+	const shift = 8 - dominantBits
+
+	cells := make(map[int][][3]uint8)
+	largest := -1
+	for _, p := range pixels {
+		key := int(p[0]>>shift)<<(2*dominantBits) | int(p[1]>>shift)<<dominantBits | int(p[2]>>shift)
+		cells[key] = append(cells[key], p)
+
+		if largest == -1 || len(cells[key]) > len(cells[largest]) {
+			largest = key
+		}
+	}
+	return cells[largest]
+}
+
+func averageColor(pixels [][3]uint8) [3]uint8 {
+	var sum [3]int
+	for _, p := range pixels {
+		for c := 0; c < 3; c++ {
+			sum[c] += int(p[c])
+		}
+	}
+
+	var avg [3]uint8
+	for c := 0; c < 3; c++ {
+		avg[c] = uint8(sum[c] / len(pixels))
+	}
+	return avg
+}
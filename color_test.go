@@ -0,0 +1,22 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestDominantColorCoversMostOfImage(t *testing.T) {
+	// 90% white with a dark stripe along the left
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(img, img.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 10, 100), image.NewUniform(color.NRGBA{0x20, 0x20, 0x20, 0xff}), image.Point{}, draw.Src)
+
+	if c := placeholderColor(img, "dominant"); c != "#ffffff" {
+		t.Errorf("dominant color is %s, expected #ffffff", c)
+	}
+	if c := placeholderColor(img, "average"); c == "#ffffff" {
+		t.Errorf("average color is %s, expected the stripe to darken it", c)
+	}
+}
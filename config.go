@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+)
+
+// ResolvedConfig is the configuration a run ends up with after parsing and
+// expanding every option, as printed by -printConfig.
+type ResolvedConfig struct {
+	Options     map[string]string `json:"options"`
+	Sizes       []ResolvedSize    `json:"sizes"`
+	Pipeline    []PipelineStep    `json:"pipeline"`
+	OutputDir   string            `json:"outputDir,omitempty"`
+	FormatDirs  map[string]string `json:"formatDirs,omitempty"`
+	SourceRoots []string          `json:"sourceRoots,omitempty"`
+	Files       []string          `json:"files"`
+}
+
+type ResolvedSize struct {
+	Name      string  `json:"name"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	Format    string  `json:"format"`
+	Sharpen   float64 `json:"sharpen,omitempty"`
+	Posterize int     `json:"posterize,omitempty"`
+}
+
+// printConfig writes the resolved configuration for files to stdout as JSON.
+func printConfig(files []string) error {
+	cfg := ResolvedConfig{
+		Options:     make(map[string]string),
+		OutputDir:   *outFolder,
+		FormatDirs:  formatDirs,
+		SourceRoots: srcRoots,
+		Pipeline:    pipeline,
+		Files:       files,
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		cfg.Options[f.Name] = f.Value.String()
+	})
+
+	for _, s := range sizes {
+		cfg.Sizes = append(cfg.Sizes, ResolvedSize{
+			Name:      s.String(),
+			Width:     s.Width,
+			Height:    s.Height,
+			Format:    s.Format,
+			Sharpen:   s.sharpen(),
+			Posterize: s.posterize(),
+		})
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+const contactSheetLabelHeight = 16
+
+// writeContactSheets composites a labeled thumbnail of every file into a grid,
+// writing as many pages as needed to fit all of them.
+func writeContactSheets(files []string, path string) error {
+	if *sheetCols <= 0 || *sheetRows <= 0 || *sheetCell <= 0 {
+		return fmt.Errorf("columns, rows and cell size must be positive")
+	}
+	// Cells must fit a label of at least two characters and a thumbnail above it
+	if minCell := maxInt(2*basicfont.Face7x13.Advance, contactSheetLabelHeight+1); *sheetCell < minCell {
+		return fmt.Errorf("cell size must be at least %d to fit labels", minCell)
+	}
+
+	thumbs := make([]image.Image, len(files))
+
+	var g errgroup.Group
+	sem := semaphore.NewWeighted(int64(*parallel))
+	for i, f := range files {
+		i, f := i, f
+
+		g.Go(func() error {
+			sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			img, err := imaging.Open(f)
+			if err != nil {
+				return fmt.Errorf("open image %s: %w", f, err)
+			}
+
+			thumbs[i] = imaging.Fit(img, *sheetCell, *sheetCell-contactSheetLabelHeight, imaging.Lanczos)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	perPage := *sheetCols * *sheetRows
+	pages := (len(files) + perPage - 1) / perPage
+
+	ext := filepath.Ext(path)
+	format := strings.TrimPrefix(strings.ToLower(ext), ".")
+
+	for page := 0; page < pages; page++ {
+		from := page * perPage
+		to := from + perPage
+		if to > len(files) {
+			to = len(files)
+		}
+
+		sheet := renderContactSheet(files[from:to], thumbs[from:to])
+
+		pagePath := path
+		if pages > 1 {
+			pagePath = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), page+1, ext)
+		}
+
+		out, err := outFS.Create(pagePath)
+		if err != nil {
+			return fmt.Errorf("create file %s: %w", pagePath, err)
+		}
+
+		if err := encode(out, sheet, Size{Format: format}, *quality); err != nil {
+			out.Close()
+			return fmt.Errorf("encode file %s: %w", pagePath, err)
+		}
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("write file %s: %w", pagePath, err)
+		}
+
+		if !*quiet {
+			log.Printf("wrote contact sheet %s", pagePath)
+		}
+	}
+
+	return nil
+}
+
+func renderContactSheet(files []string, thumbs []image.Image) *image.NRGBA {
+	cols := *sheetCols
+	if len(files) < cols {
+		cols = len(files)
+	}
+	rows := (len(files) + cols - 1) / cols
+	cell := *sheetCell
+
+	sheet := imaging.New(cols*cell, rows*cell, color.White)
+
+	drawer := &font.Drawer{
+		Dst:  sheet,
+		Src:  image.Black,
+		Face: basicfont.Face7x13,
+	}
+	maxChars := cell / basicfont.Face7x13.Advance
+
+	for i, thumb := range thumbs {
+		x, y := (i%cols)*cell, (i/cols)*cell
+
+		// Center the thumbnail in the space above the label
+		tx := x + (cell-thumb.Bounds().Dx())/2
+		ty := y + (cell-contactSheetLabelHeight-thumb.Bounds().Dy())/2
+		draw.Draw(sheet, thumb.Bounds().Sub(thumb.Bounds().Min).Add(image.Pt(tx, ty)), thumb, thumb.Bounds().Min, draw.Over)
+
+		label := filepath.Base(files[i])
+		if len(label) > maxChars {
+			label = label[:maxChars-1] + "~"
+		}
+
+		width := drawer.MeasureString(label).Ceil()
+		drawer.Dot = fixed.P(x+(cell-width)/2, y+cell-4)
+		drawer.DrawString(label)
+	}
+
+	return sheet
+}
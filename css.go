@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// writeCSSImageSet writes a CSS rule using image-set() to pick between the
+// variants of a source by resolution and type. The smallest variant is 1x and
+// the density of the others is relative to its width, variants of the same size
+// are listed in -negotiationOrder.
+func writeCSSImageSet(source, cssPath string, variants []plannedVariant, w, h int) error {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	width := func(v plannedVariant) int {
+		vw, _ := v.size.Dimensions(w, h)
+		return vw
+	}
+
+	sorted := make([]plannedVariant, len(variants))
+	copy(sorted, variants)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		wi, wj := width(sorted[i]), width(sorted[j])
+		if wi != wj {
+			return wi < wj
+		}
+		return formatRank(sorted[i].size.Format) < formatRank(sorted[j].size.Format)
+	})
+
+	base := width(sorted[0])
+	if base <= 0 {
+		return fmt.Errorf("invalid variant width %d", base)
+	}
+
+	dir := filepath.Dir(cssPath)
+	url := func(v plannedVariant) string {
+		rel, err := filepath.Rel(dir, v.path)
+		if err != nil {
+			rel = v.path
+		}
+		return strconv.Quote(filepath.ToSlash(rel))
+	}
+
+	name := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	selector := strings.ReplaceAll(*cssSelector, "{name}", name)
+
+	// Browsers without image-set() support get the most widely supported format
+	// of the smallest size
+	fallback := sorted[0]
+	for _, v := range sorted[1:] {
+		if width(v) == base {
+			fallback = v
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s {\n", selector)
+	fmt.Fprintf(&b, "  %s: url(%s);\n", *cssProperty, url(fallback))
+	fmt.Fprintf(&b, "  %s: image-set(\n", *cssProperty)
+
+	for i, v := range sorted {
+		density := formatDensity(width(v), base)
+
+		sep := ","
+		if i == len(sorted)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(&b, "    url(%s) type(%q) %sx%s\n", url(v), mimeType(v.size.Format), density, sep)
+	}
+
+	b.WriteString("  );\n}\n")
+
+	if err := writeOutputFile(cssPath, []byte(b.String())); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+	return nil
+}
+
+// formatDensity returns the density of a variant w pixels wide relative to one
+// base pixels wide, rounded to two decimals.
+func formatDensity(w, base int) string {
+	return strconv.FormatFloat(math.Round(float64(w)/float64(base)*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"container/list"
+	"image"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// decodedSource is a source image decoded and prepared for resizing.
+type decodedSource struct {
+	img        image.Image
+	svg        *svgSource
+	decodeTime time.Duration
+}
+
+// DecodedCache keeps the most recently used decoded sources in memory, up to a
+// total size in bytes, so that unchanged sources aren't decoded again. It is
+// safe for concurrent use.
+type DecodedCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+
+	// Most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type decodedEntry struct {
+	path    string
+	modTime time.Time
+	size    int64
+	bytes   int64
+	source  *decodedSource
+}
+
+func newDecodedCache(maxBytes int64) *DecodedCache {
+	return &DecodedCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the source decoded from path, if it's cached and the file
+// described by fi hasn't changed since.
+func (c *DecodedCache) Get(path string, fi fs.FileInfo) (*decodedSource, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*decodedEntry)
+	if !entry.modTime.Equal(fi.ModTime()) || entry.size != fi.Size() {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.source, true
+}
+
+// Add caches the source decoded from path, whose file is described by fi,
+// evicting the least recently used sources to make room for it. Sources larger
+// than the whole cache aren't cached.
+func (c *DecodedCache) Add(path string, fi fs.FileInfo, src *decodedSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[path]; ok {
+		c.remove(el)
+	}
+
+	n := imageBytes(src.img)
+	if n > c.maxBytes {
+		return
+	}
+
+	for c.bytes+n > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+
+	c.entries[path] = c.order.PushFront(&decodedEntry{
+		path:    path,
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		bytes:   n,
+		source:  src,
+	})
+	c.bytes += n
+}
+
+func (c *DecodedCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*decodedEntry)
+	delete(c.entries, entry.path)
+	c.bytes -= entry.bytes
+}
+
+// imageBytes returns how much memory the pixels of img take.
+func imageBytes(img image.Image) int64 {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return int64(len(img.Pix))
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.Gray:
+		return int64(len(img.Pix))
+	case *image.YCbCr:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	}
+
+	return int64(img.Bounds().Dx()) * int64(img.Bounds().Dy()) * 4
+}
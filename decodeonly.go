@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// decodeAll fully decodes every file, up to parallel at a time, without resizing
+// or writing anything. The time each decode took is logged and added to the job
+// report, files that can't be decoded are reported as failures.
+func decodeAll(files []string, parallel int) {
+	var mu sync.Mutex
+	var total time.Duration
+	decoded := 0
+
+	wg := sync.WaitGroup{}
+	sem := semaphore.NewWeighted(int64(parallel))
+
+	for _, f := range files {
+		wg.Add(1)
+		go func(f string) {
+			defer wg.Done()
+			if ordered != nil {
+				defer ordered.Release(f)
+			}
+
+			sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			d, err := decodeTimed(f)
+			if err != nil {
+				failures.Fail(f, "failed to decode image", err)
+				return
+			}
+
+			if !*quiet {
+				logImage(f, "decoded image %s in %s", f, d)
+			}
+			reportJob(&Job{origPath: f}, JobTimings{Decode: d})
+
+			mu.Lock()
+			total += d
+			decoded++
+			mu.Unlock()
+		}(f)
+	}
+	wg.Wait()
+
+	if !*quiet && decoded > 0 {
+		log.Printf("decoded %d images, %s on average", decoded, total/time.Duration(decoded))
+	}
+}
+
+func decodeTimed(path string) (time.Duration, error) {
+	f, err := osFS{}.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	start := time.Now()
+	if _, err := decodeSource(f, path); err != nil {
+		return 0, fmt.Errorf("decode image: %w", err)
+	}
+
+	return time.Since(start), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// hardlinkDuplicates replaces outputs with identical contents with hardlinks to
+// a single copy. If the filesystem doesn't support hardlinks nothing is changed.
+func hardlinkDuplicates(outputs []Output) error {
+	// Only files with the same size can have the same contents, so avoid hashing the rest
+	bySize := make(map[int64][]string)
+	seen := make(map[string]bool)
+	for _, o := range outputs {
+		// Outputs named by hash are listed once per variant they stand for,
+		// linking a file to itself would leave the temporary link behind
+		if seen[o.Path] {
+			continue
+		}
+		seen[o.Path] = true
+
+		bySize[o.Bytes] = append(bySize[o.Bytes], o.Path)
+	}
+
+	var linked int
+	var saved int64
+
+	for size, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+
+		byHash := make(map[[sha256.Size]byte][]string)
+		for _, p := range paths {
+			sum, err := hashFile(p)
+			if err != nil {
+				return fmt.Errorf("hash file %s: %w", p, err)
+			}
+
+			byHash[sum] = append(byHash[sum], p)
+		}
+
+		for _, group := range byHash {
+			original := group[0]
+
+			for _, dup := range group[1:] {
+				tmp := dup + ".link"
+
+				if err := os.Link(original, tmp); err != nil {
+					if linked == 0 {
+						log.Printf("hardlinks are not supported, not deduplicating outputs: %s", err)
+						return nil
+					}
+					return fmt.Errorf("link %s to %s: %w", dup, original, err)
+				}
+				if err := os.Rename(tmp, dup); err != nil {
+					os.Remove(tmp)
+					return fmt.Errorf("replace %s: %w", dup, err)
+				}
+
+				linked++
+				saved += size
+			}
+		}
+	}
+
+	if !*quiet && linked > 0 {
+		log.Printf("hardlinked %d duplicate outputs, saving %d bytes", linked, saved)
+	}
+
+	return nil
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHardlinkDuplicatesSkipsRepeatedPaths(t *testing.T) {
+	oldQuiet := *quiet
+	defer func() { *quiet = oldQuiet }()
+	*quiet = true
+
+	dir := t.TempDir()
+	data := []byte("identical output")
+	hashed, dup := filepath.Join(dir, "3a7bd3e2.png"), filepath.Join(dir, "photo-480p.png")
+	for _, p := range []string{hashed, dup} {
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// With -nameByHash identical variants share a single output
+	size := int64(len(data))
+	outputs := []Output{
+		{Path: hashed, Bytes: size},
+		{Path: hashed, Bytes: size},
+		{Path: dup, Bytes: size},
+	}
+	if err := hardlinkDuplicates(outputs); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(hashed + ".link"); !os.IsNotExist(err) {
+		t.Errorf("temporary link %s.link was left behind", hashed)
+	}
+
+	a, err := os.Stat(hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(dup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Errorf("%s wasn't linked to %s", dup, hashed)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HashDenylist is a list of perceptual hashes of images that shouldn't be
+// processed, read from a file with one 16 digit hex hash per line, optionally
+// followed by a name for it.
+type HashDenylist struct {
+	entries []deniedHash
+}
+
+type deniedHash struct {
+	hash uint64
+	name string
+}
+
+// loadHashDenylist reads a denylist from the file at path. Empty lines and lines
+// starting with # are ignored.
+func loadHashDenylist(path string) (*HashDenylist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	d := &HashDenylist{}
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		hash, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %s on line %d, expected 16 hex digits", fields[0], line)
+		}
+
+		name := strings.Join(fields[1:], " ")
+		if name == "" {
+			name = fields[0]
+		}
+		d.entries = append(d.entries, deniedHash{hash, name})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	return d, nil
+}
+
+// Match returns the name of the entry closest to hash and how many bits they
+// differ by, if any is within maxDistance bits.
+func (d *HashDenylist) Match(hash uint64, maxDistance int) (name string, distance int, ok bool) {
+	distance = maxDistance + 1
+	for _, e := range d.entries {
+		if dist := bits.OnesCount64(hash ^ e.hash); dist < distance {
+			name, distance = e.name, dist
+		}
+	}
+	return name, distance, distance <= maxDistance
+}
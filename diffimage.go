@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+
+	"github.com/disintegration/imaging"
+)
+
+// diffImagePath returns where the difference image of the output at outPath is
+// written, next to it with .diff.png appended so that the outputs of a size in
+// different formats get their own.
+func diffImagePath(outPath string) string {
+	return outPath + ".diff.png"
+}
+
+// writeDiffImage decodes the output at outPath back and writes the difference
+// between it and img, which it was encoded from, to diffImagePath. It returns
+// the largest difference found in any channel.
+func writeDiffImage(img image.Image, size Size, outPath string) (int, error) {
+	f, err := os.Open(outPath)
+	if err != nil {
+		return 0, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	decoded, _, err := image.Decode(f)
+	if err != nil {
+		return 0, fmt.Errorf("decode output: %w", err)
+	}
+
+	// -exec may have changed the output
+	if decoded.Bounds().Size() != img.Bounds().Size() {
+		return 0, fmt.Errorf("output is %dx%d, expected %dx%d", decoded.Bounds().Dx(), decoded.Bounds().Dy(), img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	// Compare with what the encoder was actually given
+	if normalizeFormat(size.Format) == "jpeg" {
+		img = flatten(img)
+	}
+
+	diff, largest := diffImage(img, decoded)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, diff); err != nil {
+		return 0, fmt.Errorf("encode difference: %w", err)
+	}
+	if err := writeOutputFile(diffImagePath(outPath), buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("write file: %w", err)
+	}
+	return largest, nil
+}
+
+// diffImage returns the absolute difference between the color channels of a and
+// b, which must have the same dimensions, stretched so that the largest
+// difference is white. Identical images give a black image. Colors are weighted
+// by their alpha, encoders are free to change those of transparent pixels.
+func diffImage(a, b image.Image) (*image.NRGBA, int) {
+	na, nb := imaging.Clone(a), imaging.Clone(b)
+	diff := image.NewNRGBA(na.Rect)
+
+	largest := 0
+	for i := 0; i < len(na.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			d := int(na.Pix[i+c])*int(na.Pix[i+3])/0xff - int(nb.Pix[i+c])*int(nb.Pix[i+3])/0xff
+			if d < 0 {
+				d = -d
+			}
+			diff.Pix[i+c] = uint8(d)
+			largest = maxInt(largest, d)
+		}
+		diff.Pix[i+3] = 0xff
+	}
+
+	if largest > 0 {
+		for i := 0; i < len(diff.Pix); i += 4 {
+			for c := 0; c < 3; c++ {
+				diff.Pix[i+c] = uint8(int(diff.Pix[i+c]) * 255 / largest)
+			}
+		}
+	}
+	return diff, largest
+}
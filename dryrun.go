@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// planManifest builds the manifest a run over files would write without
+// decoding or encoding any image. Variant paths and dimensions are computed
+// from the sizes and the dimensions of each source as read from its header,
+// byte sizes are left out.
+func planManifest(fsys fs.FS, files []string) (*Manifest, error) {
+	infos := &SourceInfos{}
+	var planned []Output
+
+	for _, path := range files {
+		cfg, err := decodeConfig(fsys, path)
+		if err != nil {
+			return nil, fmt.Errorf("read image %s: %w", path, err)
+		}
+
+		aspect := float64(cfg.Width) / float64(cfg.Height)
+		if (*minAspect > 0 && aspect < *minAspect) || (*maxAspect > 0 && aspect > *maxAspect) {
+			continue
+		}
+
+		info := &SourceInfo{Path: path, Width: cfg.Width, Height: cfg.Height}
+		if fi, err := fs.Stat(fsys, path); err == nil {
+			info.ModTime = fi.ModTime()
+		}
+		if info.Hash, err = sourceHash(fsys, path); err != nil {
+			return nil, fmt.Errorf("hash file %s: %w", path, err)
+		}
+		infos.Add(info)
+
+		for _, size := range sourceSizes(path, sizes) {
+			newpath, err := variantPath(path, size)
+			if err != nil {
+				return nil, err
+			}
+
+			w, h := size.Dimensions(cfg.Width, cfg.Height)
+			planned = append(planned, Output{
+				Source: path,
+				Path:   newpath,
+				Format: size.Format,
+				Size:   size,
+				Width:  w,
+				Height: h,
+			})
+		}
+	}
+
+	return buildManifest(infos, planned, nil, nil), nil
+}
+
+// printPlannedManifest writes the manifest planned for files to -manifest, or
+// to stdout if it isn't set.
+func printPlannedManifest(files []string) error {
+	m, err := planManifest(osFS{}, files)
+	if err != nil {
+		return err
+	}
+
+	if *manifestPath != "" {
+		return writeManifest(*manifestPath, m)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"sort"
+)
+
+// discardFS is an OutputFS that throws away everything written to it, used to
+// measure output sizes without touching the disk.
+type discardFS struct{}
+
+func (discardFS) Create(path string) (io.WriteCloser, error) {
+	return nopWriteCloser{io.Discard}, nil
+}
+
+func (discardFS) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// sampleFiles returns an evenly spread subset of files containing roughly the
+// given fraction of them.
+func sampleFiles(files []string, fraction float64) []string {
+	if fraction >= 1 || len(files) == 0 {
+		return files
+	}
+
+	step := int(math.Round(1 / fraction))
+	if step < 1 {
+		step = 1
+	}
+
+	sampled := make([]string, 0, len(files)/step+1)
+	for i := 0; i < len(files); i += step {
+		sampled = append(sampled, files[i])
+	}
+	return sampled
+}
+
+func printEstimate(estimated []Output, sampled, total int) {
+	type sizeTotal struct {
+		count int
+		bytes int64
+	}
+
+	bySize := make(map[string]*sizeTotal)
+	var sum int64
+
+	for _, o := range estimated {
+		key := o.Size.String() + " " + o.Format
+
+		t, ok := bySize[key]
+		if !ok {
+			t = &sizeTotal{}
+			bySize[key] = t
+		}
+		t.count++
+		t.bytes += o.Bytes
+		sum += o.Bytes
+
+		if !*quiet {
+			log.Printf("estimated %s at %d bytes", o.Path, o.Bytes)
+		}
+	}
+
+	keys := make([]string, 0, len(bySize))
+	for k := range bySize {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	scale := 1.0
+	if sampled > 0 {
+		scale = float64(total) / float64(sampled)
+	}
+
+	for _, k := range keys {
+		t := bySize[k]
+		log.Printf("%s: %d variants, %d bytes on average, projected %d bytes in total", k, t.count, t.bytes/int64(t.count), int64(float64(t.bytes)*scale))
+	}
+
+	log.Printf("encoded %d bytes for %d of %d images, projected %d bytes in total", sum, sampled, total, int64(float64(sum)*scale))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	exifOrientationTag        = 0x0112
+	exifIFDPointerTag         = 0x8769
+	exifDateTimeOriginalTag   = 0x9003
+	exifOffsetTimeOriginalTag = 0x9011
+)
+
+// exifEntry is an entry of a TIFF image file directory. value holds the value
+// itself if it fits in 4 bytes, otherwise its offset.
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifData is the TIFF structure held by the APP1 segment of a JPEG file.
+type exifData struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// readEXIF returns the EXIF data of the JPEG read from r, or nil if it has none.
+func readEXIF(r io.Reader) (*exifData, error) {
+	var exif []byte
+	err := readJPEGSegments(r, func(marker byte, segment []byte) bool {
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			exif = segment[6:]
+			return false
+		}
+		return true
+	})
+	if err != nil || exif == nil {
+		return nil, err
+	}
+
+	return parseEXIF(exif)
+}
+
+// readJPEGSegments calls fn with every segment of the JPEG read from r up to the
+// image data, stopping early if fn returns false. It does nothing if r doesn't
+// hold a JPEG.
+func readJPEGSegments(r io.Reader, fn func(marker byte, segment []byte) bool) error {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil
+	}
+
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:2]); err != nil {
+			return err
+		}
+		if marker[0] != 0xff {
+			return fmt.Errorf("invalid JPEG marker")
+		}
+
+		// Image data starts after the start of scan, metadata comes before it
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil
+		}
+
+		if _, err := io.ReadFull(br, marker[2:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return fmt.Errorf("invalid JPEG segment length")
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return err
+		}
+
+		if !fn(marker[1], segment) {
+			return nil
+		}
+	}
+}
+
+func parseEXIF(data []byte) (*exifData, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("EXIF data too short")
+	}
+
+	e := &exifData{data: data}
+	switch string(data[:2]) {
+	case "II":
+		e.order = binary.LittleEndian
+	case "MM":
+		e.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid EXIF byte order")
+	}
+
+	return e, nil
+}
+
+// ifd0 returns the entries of the first image file directory.
+func (e *exifData) ifd0() ([]exifEntry, error) {
+	return e.entries(e.order.Uint32(e.data[4:]))
+}
+
+// entries returns the entries of the image file directory at offset.
+func (e *exifData) entries(offset uint32) ([]exifEntry, error) {
+	if int64(offset)+2 > int64(len(e.data)) {
+		return nil, fmt.Errorf("EXIF directory out of bounds")
+	}
+
+	n := int(e.order.Uint16(e.data[offset:]))
+	start := int(offset) + 2
+	if start+n*12 > len(e.data) {
+		return nil, fmt.Errorf("EXIF directory out of bounds")
+	}
+
+	entries := make([]exifEntry, n)
+	for i := range entries {
+		b := e.data[start+i*12:]
+		entries[i] = exifEntry{
+			tag:   e.order.Uint16(b),
+			typ:   e.order.Uint16(b[2:]),
+			count: e.order.Uint32(b[4:]),
+			value: b[8:12],
+		}
+	}
+
+	return entries, nil
+}
+
+// string returns the value of an ASCII entry.
+func (e *exifData) string(entry exifEntry) (string, error) {
+	if entry.typ != 2 {
+		return "", fmt.Errorf("EXIF entry %#x isn't text", entry.tag)
+	}
+
+	b := entry.value
+	if entry.count <= 4 {
+		b = b[:entry.count]
+	} else {
+		offset := int64(e.order.Uint32(entry.value))
+		if offset+int64(entry.count) > int64(len(e.data)) {
+			return "", fmt.Errorf("EXIF value out of bounds")
+		}
+		b = e.data[offset : offset+int64(entry.count)]
+	}
+
+	return strings.TrimRight(string(b), "\x00 "), nil
+}
+
+// exifOrientation returns the EXIF orientation of the JPEG read from r, which
+// is 1 if it has none.
+func exifOrientation(r io.Reader) int {
+	e, err := readEXIF(r)
+	if err != nil || e == nil {
+		return 1
+	}
+
+	entries, err := e.ifd0()
+	if err != nil {
+		return 1
+	}
+
+	for _, entry := range entries {
+		if entry.tag == exifOrientationTag {
+			if o := int(e.order.Uint16(entry.value)); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+
+	return 1
+}
+
+// exifCaptureTime returns when the photo in the JPEG read from r was taken
+// according to its EXIF DateTimeOriginal, which is in the time zone given by
+// OffsetTimeOriginal or in local time if it has none.
+func exifCaptureTime(r io.Reader) (time.Time, bool) {
+	e, err := readEXIF(r)
+	if err != nil || e == nil {
+		return time.Time{}, false
+	}
+
+	ifd0, err := e.ifd0()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var entries []exifEntry
+	for _, entry := range ifd0 {
+		if entry.tag == exifIFDPointerTag {
+			entries, err = e.entries(e.order.Uint32(entry.value))
+			if err != nil {
+				return time.Time{}, false
+			}
+		}
+	}
+
+	var date, offset string
+	for _, entry := range entries {
+		switch entry.tag {
+		case exifDateTimeOriginalTag:
+			date, _ = e.string(entry)
+		case exifOffsetTimeOriginalTag:
+			offset, _ = e.string(entry)
+		}
+	}
+
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", date+offset); err == nil {
+			return t, true
+		}
+	}
+	if t, err := time.ParseInLocation("2006:01:02 15:04:05", date, time.Local); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FailureList records the sources that failed to be processed, optionally
+// writing them to a file as they happen. It is safe for concurrent use.
+type FailureList struct {
+	mu   sync.Mutex
+	f    *os.File
+	seen map[string]bool
+}
+
+// newFailureList creates a failure list, if path is not empty the failed sources
+// are written to it one per line, truncating it first.
+func newFailureList(path string) (*FailureList, error) {
+	l := &FailureList{seen: make(map[string]bool)}
+
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("create file: %w", err)
+		}
+		l.f = f
+	}
+
+	return l, nil
+}
+
+// Fail records that the source at path failed with err. Unless -keepGoing is
+// set, the program exits.
+func (l *FailureList) Fail(path, msg string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.seen[path] {
+		l.seen[path] = true
+
+		if l.f != nil {
+			if _, werr := fmt.Fprintln(l.f, path); werr != nil {
+				log.Printf("failed to write to failure list: %s", werr)
+			}
+		}
+	}
+
+	reportProgress(path, "error", logFields{"error": err.Error()})
+
+	if !*keepGoing {
+		if l.f != nil {
+			l.f.Close()
+		}
+		log.Fatalf("%s %s: %s", msg, path, err)
+	}
+
+	logEvent(path, "error", logFields{"error": err.Error()}, "%s %s: %s", msg, path, err)
+}
+
+// Count returns the number of sources that failed.
+func (l *FailureList) Count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.seen)
+}
+
+func (l *FailureList) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// readFileList reads a list of source paths, one per line. Empty lines and
+// lines starting with # are ignored.
+func readFileList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	var files []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	return files, nil
+}
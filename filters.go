@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearest":           imaging.NearestNeighbor,
+	"box":               imaging.Box,
+	"linear":            imaging.Linear,
+	"hermite":           imaging.Hermite,
+	"mitchellnetravali": imaging.MitchellNetravali,
+	"catmullrom":        imaging.CatmullRom,
+	"bspline":           imaging.BSpline,
+	"gaussian":          imaging.Gaussian,
+	"bartlett":          imaging.Bartlett,
+	"lanczos":           imaging.Lanczos,
+	"hann":              imaging.Hann,
+	"hamming":           imaging.Hamming,
+	"blackman":          imaging.Blackman,
+	"welch":             imaging.Welch,
+	"cosine":            imaging.Cosine,
+}
+
+// autoFilter picks area averaging for large reductions, where it avoids the
+// ringing Lanczos can produce, and Lanczos otherwise.
+const autoFilter = "auto"
+
+// largeReduction is the scale factor from which a reduction counts as large.
+const largeReduction = 2
+
+func checkFilter(name string) error {
+	if name == autoFilter {
+		return nil
+	}
+
+	if _, ok := resampleFilters[strings.ToLower(name)]; !ok {
+		names := make([]string, 0, len(resampleFilters))
+		for n := range resampleFilters {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return fmt.Errorf("unknown filter %s, must be one of %s", name, strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+// resize resizes img to w by h, choosing the filter depending on whether the
+// image is being scaled up or down.
+func resize(img image.Image, w, h int) *image.NRGBA {
+	name := resizeFilter(img.Bounds().Dx(), img.Bounds().Dy(), w, h)
+	return imaging.Resize(img, w, h, resampleFilters[name])
+}
+
+// resizeFilter returns the name of the filter resize uses to resize a srcw by
+// srch image to w by h.
+func resizeFilter(srcw, srch, w, h int) string {
+	name := *upscaleFilter
+	if w <= srcw && h <= srch {
+		name = *downscaleFilter
+	}
+
+	if name == autoFilter {
+		if srcw >= w*largeReduction && srch >= h*largeReduction {
+			name = "box"
+		} else {
+			name = "lanczos"
+		}
+	}
+
+	return strings.ToLower(name)
+}
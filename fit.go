@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Modes for sizes with both a width and a height, set with -mode.
+const (
+	// modeFit scales the image to fit inside the box, keeping its aspect ratio.
+	modeFit = "fit"
+	// modeFill scales the image to cover the box and crops what sticks out.
+	modeFill = "fill"
+	// modePad scales the image to fit inside the box and fills the rest of it
+	// with -background, or a blurred copy of the image with -padBlurredSource.
+	modePad = "pad"
+)
+
+var anchors = map[string]imaging.Anchor{
+	"center":      imaging.Center,
+	"top":         imaging.Top,
+	"bottom":      imaging.Bottom,
+	"left":        imaging.Left,
+	"right":       imaging.Right,
+	"topleft":     imaging.TopLeft,
+	"topright":    imaging.TopRight,
+	"bottomleft":  imaging.BottomLeft,
+	"bottomright": imaging.BottomRight,
+}
+
+// padBlurDivisor sets how blurred the backdrop of -padBlurredSource is, its
+// sigma is the largest dimension of the box divided by this.
+const padBlurDivisor = 40
+
+// backgroundColor is the color padding is filled with, parsed from -background.
+var backgroundColor color.Color = color.Transparent
+
+// parseColor parses a color in the form #rrggbb or #rrggbbaa.
+func parseColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %s, expected #rrggbb or #rrggbbaa", s)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %s: %w", s, err)
+	}
+
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// isBox returns whether the size sets both dimensions, so -mode applies to it.
+func (s Size) isBox() bool {
+	return s.Width != 0 && s.Height != 0
+}
+
+// isScale returns whether the size scales each axis of the source by a factor.
+func (s Size) isScale() bool {
+	return s.ScaleX != 0 && s.ScaleY != 0
+}
+
+// hasAspect returns whether the size is cropped to an aspect ratio.
+func (s Size) hasAspect() bool {
+	return s.AspectW != 0 && s.AspectH != 0
+}
+
+// aspectBox returns the dimensions outputs of a size with an aspect ratio are
+// cropped to.
+func (s Size) aspectBox() (int, int) {
+	return maxInt(1, int(math.Round(float64(s.Height*s.AspectW)/float64(s.AspectH)))), s.Height
+}
+
+// keepsAspect returns whether outputs of this size are a plain scale of the
+// source, without cropping, padding or distorting it.
+func (s Size) keepsAspect() bool {
+	if s.isScale() {
+		return s.ScaleX == s.ScaleY
+	}
+	if s.hasAspect() {
+		return false
+	}
+	return !s.isBox() || *resizeMode == modeFit
+}
+
+// mode returns the mode outputs of this box size are made with from a w by h
+// source, which is -mode except that fill falls back to fit for sources whose
+// aspect ratio is within -aspectTolerance of the box, to avoid cropping a few pixels.
+// Sizes with an aspect ratio are always filled.
+func (s Size) mode(w, h int) string {
+	if s.hasAspect() {
+		return modeFill
+	}
+	if *resizeMode != modeFill || *aspectTolerance <= 0 {
+		return *resizeMode
+	}
+
+	src := float64(w) / float64(h)
+	box := float64(s.Width) / float64(s.Height)
+	if math.Abs(src/box-1) <= *aspectTolerance {
+		return modeFit
+	}
+	return modeFill
+}
+
+// fitDimensions returns the largest dimensions with the aspect ratio of w by h
+// that fit inside boxw by boxh.
+func fitDimensions(w, h, boxw, boxh int) (int, int) {
+	scale := math.Min(float64(boxw)/float64(w), float64(boxh)/float64(h))
+
+	return maxInt(1, int(math.Round(float64(w)*scale))), maxInt(1, int(math.Round(float64(h)*scale)))
+}
+
+// resizeToSize resizes img to w by h, the dimensions of size for the source.
+// Sizes that set both dimensions are cropped or padded according to -mode.
+// img must already be oriented by decodeSource, so that -anchor refers to the
+// image as it's displayed rather than to how its pixels are stored.
+func resizeToSize(img image.Image, size Size, w, h int) image.Image {
+	srcw, srch := img.Bounds().Dx(), img.Bounds().Dy()
+
+	mode := modeFit
+	if size.isBox() || size.hasAspect() {
+		mode = size.mode(srcw, srch)
+	}
+
+	if mode == modeFit {
+		if srcw == w && srch == h {
+			return img
+		}
+		return resize(img, w, h)
+	}
+
+	if mode == modeFill {
+		scale := math.Max(float64(w)/float64(srcw), float64(h)/float64(srch))
+		cw := maxInt(w, int(math.Ceil(float64(srcw)*scale)))
+		ch := maxInt(h, int(math.Ceil(float64(srch)*scale)))
+
+		if *smartCropOn {
+			return smartCrop(resize(img, cw, ch), w, h)
+		}
+		return imaging.CropAnchor(resize(img, cw, ch), w, h, anchors[*anchor])
+	}
+
+	fw, fh := fitDimensions(srcw, srch, w, h)
+
+	var bg *image.NRGBA
+	if *padBlurred {
+		bg = imaging.Blur(imaging.Fill(img, w, h, imaging.Center, imaging.Box), float64(maxInt(w, h))/padBlurDivisor)
+	} else {
+		bg = imaging.New(w, h, backgroundColor)
+	}
+
+	return imaging.PasteCenter(bg, resize(img, fw, fh))
+}
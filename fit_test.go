@@ -0,0 +1,39 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestFillAnchorsToOrientedTop(t *testing.T) {
+	withAutoOrient(t)
+	oldMode, oldAnchor := *resizeMode, *anchor
+	defer func() { *resizeMode, *anchor = oldMode, oldAnchor }()
+	*resizeMode = modeFill
+
+	// Stored, the red half is on the left, so anchoring to the stored top
+	// would keep half of each color
+	img := decodeTestSource(t, writeRotatedJPEG(t))
+	size := Size{Width: 200, Height: 100, Format: "jpeg"}
+
+	for _, test := range []struct {
+		anchor string
+		want   color.NRGBA
+	}{
+		{"top", red},
+		{"bottom", blue},
+	} {
+		*anchor = test.anchor
+
+		out := resizeToSize(img, size, 200, 100)
+		if w, h := out.Bounds().Dx(), out.Bounds().Dy(); w != 200 || h != 100 {
+			t.Fatalf("output is %dx%d, expected 200x100", w, h)
+		}
+		b := out.Bounds()
+		for _, x := range []int{b.Min.X + 10, b.Max.X - 10} {
+			if c := out.At(x, b.Min.Y+50); !isColor(c, test.want) {
+				t.Errorf("-anchor %s kept %v at x=%d, expected %v", test.anchor, c, x, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FormatMap overrides the format of every output of the images listed in a CSV
+// file of path,format rows, where path may also be a glob.
+type FormatMap struct {
+	exact map[string]string
+	globs []formatGlob
+}
+
+type formatGlob struct {
+	pattern string
+	format  string
+}
+
+// loadFormatMap reads a format map from the CSV file at path. A first row whose
+// format isn't known is taken as a header and skipped.
+func loadFormatMap(path string) (*FormatMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+
+	m := &FormatMap{exact: make(map[string]string)}
+
+	for row := 1; ; row++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+
+		format := strings.ToLower(strings.TrimSpace(rec[1]))
+		switch normalizeFormat(format) {
+		case "webp", "jpeg", "png":
+		default:
+			if row == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("invalid format %s for %s, expected webp, jpg or png", rec[1], rec[0])
+		}
+
+		if strings.ContainsAny(rec[0], "*?[") {
+			m.globs = append(m.globs, formatGlob{rec[0], format})
+		} else {
+			m.exact[filepath.Clean(rec[0])] = format
+		}
+	}
+
+	return m, nil
+}
+
+// Format returns the format for the image at path. Exact paths take precedence
+// over globs, which are tried in the order they are listed.
+func (m *FormatMap) Format(path string) (string, bool) {
+	if f, ok := m.exact[filepath.Clean(path)]; ok {
+		return f, true
+	}
+
+	for _, g := range m.globs {
+		if matchGlob(g.pattern, path) {
+			return g.format, true
+		}
+	}
+
+	return "", false
+}
+
+// sourceSizes returns the sizes to generate for the image at path, which are
+// sizes in the format of the image with -fixOrientation, or in the one
+// -formatMap gives it if any. Sizes that end up the same once their format is
+// overridden are only kept once.
+func sourceSizes(path string, sizes []Size) []Size {
+	var format string
+	if *fixOrientation {
+		format = sourceFormat(path)
+	}
+	if formatMap != nil {
+		if f, ok := formatMap.Format(path); ok {
+			format = f
+		}
+	}
+	if format == "" {
+		return sizes
+	}
+
+	var overridden []Size
+	seen := make(map[Size]bool)
+
+	for _, s := range sizes {
+		s.Format = format
+
+		if !seen[s] {
+			seen[s] = true
+			overridden = append(overridden, s)
+		}
+	}
+
+	return overridden
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// OutputFS is where encoded images and sidecar files are written to.
+type OutputFS interface {
+	Create(path string) (io.WriteCloser, error)
+	Stat(path string) (fs.FileInfo, error)
+}
+
+// osFS reads and writes files using the host file system. Unlike os.DirFS it
+// accepts any path the os package does, including absolute and parent paths.
+type osFS struct{}
+
+func (osFS) Open(path string) (fs.File, error) {
+	return os.Open(path)
+}
+
+func (osFS) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (osFS) Create(path string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if !*lockOutputs {
+		return os.Create(path)
+	}
+
+	// Don't truncate until we hold the lock, another process may be writing to it
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock file: %w", err)
+	}
+	if err := f.Truncate(0); err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, err
+	}
+
+	return &lockedFile{File: f}, nil
+}
+
+// lockedFile is a file that is unlocked when closed.
+type lockedFile struct {
+	*os.File
+	closed bool
+}
+
+func (f *lockedFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+
+	unlockFile(f.File)
+	return f.File.Close()
+}
+
+func writeOutputFile(path string, data []byte) error {
+	f, err := outFS.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
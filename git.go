@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitChangedFiles returns the absolute paths of the files that changed since ref
+// in the git repository containing the working directory, including uncommitted
+// and untracked files.
+func gitChangedFiles(ref string) (map[string]bool, error) {
+	top, err := gitOutput("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root := strings.TrimSpace(top)
+
+	diff, err := gitOutput("diff", "--name-only", "-z", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := gitOutput("ls-files", "--others", "--exclude-standard", "--full-name", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]bool)
+	for _, name := range strings.Split(diff+untracked, "\x00") {
+		if name != "" {
+			changed[filepath.Join(root, filepath.FromSlash(name))] = true
+		}
+	}
+
+	return changed, nil
+}
+
+// gitOutput runs git with args from the root of the repository and returns
+// what it printed.
+func gitOutput(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// filterChanged returns the files that are in changed.
+func filterChanged(files []string, changed map[string]bool) []string {
+	var out []string
+
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			continue
+		}
+
+		// The repository root is reported with symlinks resolved
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+
+		if changed[abs] {
+			out = append(out, f)
+		}
+	}
+
+	return out
+}
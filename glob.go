@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// expandGlob returns the files matching pattern. Besides the syntax supported by
+// filepath.Match, a ** path element matches any number of nested folders.
+func expandGlob(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+
+	// Walk from the part of the pattern before the first **, matching the rest
+	// element by element
+	idx := strings.Index(pattern, "**")
+	root := filepath.Clean(pattern[:idx])
+	if pattern[:idx] == "" {
+		root = "."
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	patElems := splitPath(pattern)
+
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		if matchElems(patElems, splitPath(path)) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")
+}
+
+func matchElems(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchElems(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	ok, _ := filepath.Match(pattern[0], path[0])
+	return ok && matchElems(pattern[1:], path[1:])
+}
+
+// matchGlob returns whether path matches pattern, with the syntax of expandGlob.
+func matchGlob(pattern, path string) bool {
+	return matchElems(splitPath(pattern), splitPath(path))
+}
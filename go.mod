@@ -5,6 +5,8 @@ go 1.16
 require (
 	github.com/chai2010/webp v1.1.0
 	github.com/disintegration/imaging v1.6.2
-	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d // indirect
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef
+	golang.org/x/image v0.0.0-20211028202545-6944b10bf410
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
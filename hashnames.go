@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"sync"
+)
+
+// hashedOutputs holds the paths of the outputs named by hash that are written
+// or being written in this run, so that identical outputs are only written once.
+var hashedOutputs sync.Map
+
+// hashedPath returns the SHA-256 of the encoded output of job and the path it's
+// stored at with -nameByHash, in the folder of the output and named after the
+// hash. written is set if another job of this run or a previous run already
+// wrote it, its contents are then the same so it doesn't need to be written.
+func hashedPath(job *Job, encoded []byte) (path, hash string, written bool, err error) {
+	sum := sha256.Sum256(encoded)
+	hash = hex.EncodeToString(sum[:])
+
+	dir, err := outputDir(job.origPath, job.size.Format)
+	if err != nil {
+		return "", "", false, err
+	}
+	path = filepath.Join(dir, hash+"."+outputExt(job.origPath, job.size.Format))
+
+	if _, loaded := hashedOutputs.LoadOrStore(path, true); loaded {
+		return path, hash, true, nil
+	}
+	if _, err := outFS.Stat(path); err == nil {
+		return path, hash, true, nil
+	}
+	return path, hash, false, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// runHook runs the -exec command on the output file at path, replacing {file} in
+// its arguments with the path, or appending it if there's no placeholder. The
+// command is run directly without a shell.
+func runHook(command, path string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	found := false
+	for i, a := range args {
+		if strings.Contains(a, "{file}") {
+			args[i] = strings.ReplaceAll(a, "{file}", path)
+			found = true
+		}
+	}
+	if !found {
+		args = append(args, path)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("run %s: %w: %s", args[0], err, msg)
+		}
+		return fmt.Errorf("run %s: %w", args[0], err)
+	}
+
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// srgbToXYZ and xyzToSRGB convert between linear sRGB and the D50 XYZ connection
+// space of ICC profiles, adapted from D65 with the Bradford transform.
+var (
+	srgbToXYZ = [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	xyzToSRGB = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+)
+
+// srgbTolerance is how far the colorants of a profile may be from the ones of
+// sRGB for it to be considered sRGB.
+const srgbTolerance = 0.002
+
+// iccProfile is an RGB matrix/TRC profile, which describes the color space of
+// most cameras and displays like Display P3 and Adobe RGB.
+type iccProfile struct {
+	// Columns are the XYZ of the red, green and blue colorants
+	matrix [3][3]float64
+
+	// Curves that map each encoded channel to linear light
+	curves [3]func(float64) float64
+}
+
+// readICCProfile returns the ICC profile embedded in the JPEG or PNG in data, or
+// nil if it has none.
+func readICCProfile(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return readPNGICCProfile(data)
+	}
+
+	// JPEG splits profiles over APP2 segments, each starting with its 1-based
+	// sequence number and the number of segments
+	chunks := make(map[int][]byte)
+	err := readJPEGSegments(bytes.NewReader(data), func(marker byte, segment []byte) bool {
+		const prefix = "ICC_PROFILE\x00"
+		if marker == 0xe2 && len(segment) >= len(prefix)+2 && string(segment[:len(prefix)]) == prefix {
+			chunks[int(segment[len(prefix)])] = segment[len(prefix)+2:]
+		}
+		return true
+	})
+	if err != nil || len(chunks) == 0 {
+		return nil, err
+	}
+
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	var profile []byte
+	for _, seq := range seqs {
+		profile = append(profile, chunks[seq]...)
+	}
+	return profile, nil
+}
+
+// readPNGICCProfile returns the profile held by the iCCP chunk of a PNG.
+func readPNGICCProfile(data []byte) ([]byte, error) {
+	for p := 8; p+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[p:]))
+		typ := string(data[p+4 : p+8])
+		if p+12+length > len(data) {
+			return nil, fmt.Errorf("PNG chunk out of bounds")
+		}
+		chunk := data[p+8 : p+8+length]
+
+		switch typ {
+		case "iCCP":
+			// Profile name, null separator and compression method
+			nul := bytes.IndexByte(chunk, 0)
+			if nul == -1 || nul+2 > len(chunk) {
+				return nil, fmt.Errorf("invalid iCCP chunk")
+			}
+
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[nul+2:]))
+			if err != nil {
+				return nil, fmt.Errorf("decompress profile: %w", err)
+			}
+			defer zr.Close()
+
+			return io.ReadAll(zr)
+		case "IDAT":
+			return nil, nil
+		}
+
+		p += 12 + length
+	}
+
+	return nil, nil
+}
+
+// parseICCProfile parses the colorant and tone reproduction curve tags of an
+// RGB matrix/TRC profile.
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("invalid ICC profile")
+	}
+	if string(data[16:20]) != "RGB " {
+		return nil, fmt.Errorf("unsupported color space %q", data[16:20])
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, fmt.Errorf("ICC tag table out of bounds")
+		}
+
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, fmt.Errorf("ICC tag out of bounds")
+		}
+
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	p := &iccProfile{}
+
+	for i, name := range []string{"r", "g", "b"} {
+		xyz, ok := tags[name+"XYZ"]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("missing %sXYZ tag, only matrix profiles are supported", name)
+		}
+		for j := 0; j < 3; j++ {
+			p.matrix[j][i] = s15Fixed16(xyz[8+j*4:])
+		}
+
+		trc, ok := tags[name+"TRC"]
+		if !ok {
+			return nil, fmt.Errorf("missing %sTRC tag", name)
+		}
+		curve, err := parseCurve(trc)
+		if err != nil {
+			return nil, fmt.Errorf("parse %sTRC tag: %w", name, err)
+		}
+		p.curves[i] = curve
+	}
+
+	return p, nil
+}
+
+// parseCurve parses a curv or para tag into a function mapping encoded values
+// to linear ones, both between 0 and 1.
+func parseCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("curve too short")
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+n*2 > len(tag) {
+			return nil, fmt.Errorf("curve out of bounds")
+		}
+
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 0xffff
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+
+	case "para":
+		// Number of parameters of each function type
+		counts := []int{1, 3, 4, 5, 7}
+
+		typ := int(binary.BigEndian.Uint16(tag[8:]))
+		if typ >= len(counts) || 12+counts[typ]*4 > len(tag) {
+			return nil, fmt.Errorf("invalid parametric curve")
+		}
+
+		var v [7]float64
+		for i := 0; i < counts[typ]; i++ {
+			v[i] = s15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+
+		switch typ {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}, nil
+		default:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported curve type %q", tag[:4])
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// isSRGB returns whether the colorants of p match the ones of sRGB. The curves
+// aren't compared, profiles with sRGB colorants use the sRGB curve in practice.
+func (p *iccProfile) isSRGB() bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if math.Abs(p.matrix[i][j]-srgbToXYZ[i][j]) > srgbTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toSRGB converts img from the color space of p to sRGB. Colors outside of
+// sRGB are clipped.
+func (p *iccProfile) toSRGB(img image.Image) *image.NRGBA {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToSRGB[i][k] * p.matrix[k][j]
+			}
+		}
+	}
+
+	var linear [3][256]float64
+	for c := 0; c < 3; c++ {
+		for v := 0; v < 256; v++ {
+			linear[c][v] = p.curves[c](float64(v) / 255)
+		}
+	}
+
+	// Encodes linear light with the sRGB curve, sampled finely enough to keep dark tones apart
+	const steps = 4096
+	var encoded [steps + 1]uint8
+	for i := range encoded {
+		x := float64(i) / steps
+		if x <= 0.0031308 {
+			x *= 12.92
+		} else {
+			x = 1.055*math.Pow(x, 1/2.4) - 0.055
+		}
+		encoded[i] = uint8(math.Round(x * 255))
+	}
+	encode := func(x float64) uint8 {
+		return encoded[int(math.Round(math.Max(0, math.Min(1, x))*steps))]
+	}
+
+	dst := imaging.Clone(img)
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		px := dst.Pix[i : i+3 : i+3]
+		r, g, b := linear[0][px[0]], linear[1][px[1]], linear[2][px[2]]
+
+		px[0] = encode(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+		px[1] = encode(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+		px[2] = encode(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+	}
+
+	return dst
+}
+
+// convertToSRGB converts img, decoded from the file at path, from the color space
+// described by profile to sRGB. Images that are already sRGB or whose profile
+// isn't supported are returned unchanged.
+func convertToSRGB(img image.Image, profile []byte, path string) image.Image {
+	p, err := parseICCProfile(profile)
+	if err != nil {
+		log.Printf("warning: not converting %s to sRGB: %s", path, err)
+		return img
+	}
+
+	if p.isSRGB() {
+		return img
+	}
+	return p.toSRGB(img)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	largerSkip = "skip"
+	largerCopy = "copy"
+)
+
+// useSourceInstead handles an output of job that would be larger than its
+// source, with -onlyIfSmaller. With the copy action the source is copied as is
+// next to where the output would be, with its own extension. Otherwise, or if
+// the source can't stand in for the output because it has other dimensions or
+// is transformed before resizing, nothing is written.
+func useSourceInstead(job *Job, img image.Image, encodedBytes int64, timings JobTimings) error {
+	sameImage := img.Bounds().Size() == job.img.Bounds().Size() && !transformsSource() && job.svg == nil
+	if *onlyIfSmaller != largerCopy || !sameImage {
+		if !*quiet {
+			logEvent(job.origPath, "skip", logFields{"reason": "largerThanSource", "output": job.outPath, "bytes": encodedBytes}, "skipped %s, it would be larger than its source", job.outPath)
+		}
+		return nil
+	}
+
+	ext := filepath.Ext(job.origPath)
+	copyPath := strings.TrimSuffix(job.outPath, filepath.Ext(job.outPath)) + ext
+
+	var n int64
+	if pathKey(copyPath) == pathKey(job.origPath) {
+		// The source already is where the copy would go, copying it onto itself
+		// would truncate it
+		fi, err := fs.Stat(srcFS, job.origPath)
+		if err != nil {
+			return fmt.Errorf("stat file: %w", err)
+		}
+		n = fi.Size()
+		copyPath = job.origPath
+
+		if !*quiet {
+			logImage(job.origPath, "kept %s as its own output, the %s output would be larger", job.origPath, job.size.Format)
+		}
+	} else {
+		var err error
+		if n, err = copySource(job.origPath, copyPath); err != nil {
+			return err
+		}
+
+		if !*quiet {
+			logImage(job.origPath, "copied %s to %s, the %s output would be larger", job.origPath, copyPath, job.size.Format)
+		}
+	}
+
+	job.outPath = copyPath
+	job.provenance = Provenance{Version: toolVersion()}
+	job.size.Format = normalizeFormat(strings.ToLower(strings.TrimPrefix(ext, ".")))
+	timings.Bytes = n
+	finishJob(job, img, timings)
+	return nil
+}
+
+// copySource copies the source at path to copyPath, returning how many bytes
+// were copied.
+func copySource(path, copyPath string) (int64, error) {
+	in, err := srcFS.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := outFS.Create(copyPath)
+	if err != nil {
+		return 0, fmt.Errorf("create file %s: %w", copyPath, err)
+	}
+	defer out.Close() // Just in case
+
+	n, err := io.Copy(out, in)
+	if err != nil {
+		return 0, fmt.Errorf("copy source to %s: %w", copyPath, err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("write file %s: %w", copyPath, err)
+	}
+	if *mtimeFromExif && !*estimate {
+		if err := stampCaptureTime(path, copyPath); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withCopyLarger sets -onlyIfSmaller copy and -quiet for the test.
+func withCopyLarger(t *testing.T) {
+	oldAction, oldQuiet := *onlyIfSmaller, *quiet
+	t.Cleanup(func() { *onlyIfSmaller, *quiet = oldAction, oldQuiet })
+	*onlyIfSmaller, *quiet = largerCopy, true
+}
+
+// writeTestSource writes a source at path that is never decoded, and returns
+// its contents.
+func writeTestSource(t *testing.T, path string) []byte {
+	data := []byte("not really a jpeg, but it's never decoded")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestUseSourceInsteadCopiesSource(t *testing.T) {
+	withCopyLarger(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "photo.jpg")
+	data := writeTestSource(t, src)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	job := &Job{
+		img:      img,
+		size:     Size{Height: 3, Format: "webp"},
+		outPath:  filepath.Join(dir, "out", "photo-3p.webp"),
+		origPath: src,
+	}
+	if err := useSourceInstead(job, img, 1000, JobTimings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.Join(dir, "out", "photo-3p.jpg")
+	if job.outPath != want {
+		t.Fatalf("output is %s, expected %s", job.outPath, want)
+	}
+	got, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("copy is %q, expected the source", got)
+	}
+	if job.size.Format != "jpeg" {
+		t.Errorf("output format is %s, expected jpeg", job.size.Format)
+	}
+}
+
+func TestUseSourceInsteadKeepsSource(t *testing.T) {
+	withCopyLarger(t)
+
+	src := filepath.Join(t.TempDir(), "photo.jpg")
+	data := writeTestSource(t, src)
+
+	// -size 0-webp photo.jpg plans photo.webp, whose copy would be photo.jpg
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	job := &Job{
+		img:      img,
+		size:     Size{Format: "webp"},
+		outPath:  filepath.Join(filepath.Dir(src), "photo.webp"),
+		origPath: src,
+	}
+	if err := useSourceInstead(job, img, 1000, JobTimings{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("source was changed to %q", got)
+	}
+	if job.outPath != src {
+		t.Errorf("output is %s, expected the source %s", job.outPath, src)
+	}
+	if job.size.Format != "jpeg" {
+		t.Errorf("output format is %s, expected jpeg", job.size.Format)
+	}
+}
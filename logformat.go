@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logFields are the attributes of a log event.
+type logFields map[string]interface{}
+
+// jsonLog writes log events as JSON objects, one per line, starting with the
+// time, level and msg keys like the JSON handler of log/slog, which needs a
+// newer Go than this module targets. It is safe for concurrent use.
+type jsonLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// structuredLog is set with -logFormat json.
+var structuredLog *jsonLog
+
+func (l *jsonLog) emit(level, msg string, fields logFields) {
+	var buf bytes.Buffer
+
+	field := func(key string, value interface{}) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(value))
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(data)
+	}
+
+	field("time", time.Now().Format(time.RFC3339Nano))
+	field("level", level)
+	field("msg", msg)
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field(k, fields[k])
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fmt.Fprintf(l.w, "{%s}\n", buf.Bytes())
+}
+
+// Write emits a line written by the log package as an event without fields.
+// Warnings and failures are told apart by the way their messages start.
+func (l *jsonLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+
+	level := "INFO"
+	switch {
+	case strings.HasPrefix(msg, "warning: "):
+		level, msg = "WARN", strings.TrimPrefix(msg, "warning: ")
+	case strings.HasPrefix(msg, "failed "):
+		level = "ERROR"
+	}
+
+	l.emit(level, msg, nil)
+	return len(p), nil
+}
+
+// logEvent logs an event about the image at path, or about the run if path is
+// empty, in input order with -orderedOutput. With -logFormat json the event is
+// written with its fields, otherwise the message is printed if there is one.
+func logEvent(path, event string, fields logFields, format string, args ...interface{}) {
+	if structuredLog == nil {
+		if format != "" {
+			logImage(path, format, args...)
+		}
+		return
+	}
+
+	msg := event
+	if format != "" {
+		msg = fmt.Sprintf(format, args...)
+	}
+
+	level := "INFO"
+	if event == "error" {
+		level = "ERROR"
+	}
+
+	all := logFields{"event": event}
+	if path != "" {
+		all["source"] = path
+	}
+	for k, v := range fields {
+		all[k] = v
+	}
+
+	inOrder(path, func() {
+		structuredLog.emit(level, msg, all)
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// LUT is a 3D color lookup table, indexed with red changing fastest.
+type LUT struct {
+	Size      int
+	Table     [][3]float32
+	DomainMin [3]float32
+	DomainMax [3]float32
+}
+
+func loadLUT(path string) (*LUT, error) {
+	if strings.EqualFold(filepath.Ext(path), ".cube") {
+		return loadCubeLUT(path)
+	}
+
+	return loadHaldLUT(path)
+}
+
+func loadCubeLUT(path string) (*LUT, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	lut := &LUT{DomainMax: [3]float32{1, 1, 1}}
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "TITLE":
+			continue
+
+		case "LUT_1D_SIZE":
+			return nil, fmt.Errorf("line %d: 1D LUTs are not supported", line)
+
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: malformed LUT_3D_SIZE", line)
+			}
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 2 || size > 256 {
+				return nil, fmt.Errorf("line %d: invalid LUT_3D_SIZE %s", line, fields[1])
+			}
+
+			lut.Size = size
+			lut.Table = make([][3]float32, 0, size*size*size)
+
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			v, err := parseLUTTriplet(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+
+			if fields[0] == "DOMAIN_MIN" {
+				lut.DomainMin = v
+			} else {
+				lut.DomainMax = v
+			}
+
+		default:
+			if lut.Size == 0 {
+				return nil, fmt.Errorf("line %d: table data before LUT_3D_SIZE", line)
+			}
+
+			v, err := parseLUTTriplet(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if len(lut.Table) == cap(lut.Table) {
+				return nil, fmt.Errorf("line %d: too many table entries for size %d", line, lut.Size)
+			}
+
+			lut.Table = append(lut.Table, v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	if lut.Size == 0 {
+		return nil, fmt.Errorf("missing LUT_3D_SIZE")
+	}
+	if len(lut.Table) != lut.Size*lut.Size*lut.Size {
+		return nil, fmt.Errorf("expected %d table entries, found %d", lut.Size*lut.Size*lut.Size, len(lut.Table))
+	}
+	for i := 0; i < 3; i++ {
+		if lut.DomainMax[i] <= lut.DomainMin[i] {
+			return nil, fmt.Errorf("invalid domain [%g, %g]", lut.DomainMin[i], lut.DomainMax[i])
+		}
+	}
+
+	return lut, nil
+}
+
+func parseLUTTriplet(fields []string) ([3]float32, error) {
+	var v [3]float32
+
+	if len(fields) != 3 {
+		return v, fmt.Errorf("expected 3 values, found %d", len(fields))
+	}
+
+	for i, f := range fields {
+		n, err := strconv.ParseFloat(f, 32)
+		if err != nil {
+			return v, fmt.Errorf("parse %s: %w", f, err)
+		}
+
+		v[i] = float32(n)
+	}
+
+	return v, nil
+}
+
+// loadHaldLUT loads a Hald CLUT image, which is a square image of level^3 pixels
+// per side that stores a cube of level^2 entries per side.
+func loadHaldLUT(path string) (*LUT, error) {
+	img, err := imaging.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open image: %w", err)
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	level := int(math.Round(math.Cbrt(float64(w))))
+	if w != h || level*level*level != w || level < 2 {
+		return nil, fmt.Errorf("invalid Hald image dimensions %dx%d", w, h)
+	}
+
+	nrgba := imaging.Clone(img)
+	size := level * level
+
+	lut := &LUT{
+		Size:      size,
+		Table:     make([][3]float32, size*size*size),
+		DomainMax: [3]float32{1, 1, 1},
+	}
+	for i := range lut.Table {
+		p := nrgba.Pix[i*4 : i*4+3]
+		lut.Table[i] = [3]float32{float32(p[0]) / 255, float32(p[1]) / 255, float32(p[2]) / 255}
+	}
+
+	return lut, nil
+}
+
+// Apply returns a copy of img with the LUT applied using trilinear interpolation.
+func (l *LUT) Apply(img image.Image) *image.NRGBA {
+	out := imaging.Clone(img)
+	max := float32(l.Size - 1)
+
+	for i := 0; i < len(out.Pix); i += 4 {
+		var pos [3]float32
+		for c := 0; c < 3; c++ {
+			v := (float32(out.Pix[i+c])/255 - l.DomainMin[c]) / (l.DomainMax[c] - l.DomainMin[c])
+			pos[c] = clampf(v, 0, 1) * max
+		}
+
+		rgb := l.lookup(pos)
+		for c := 0; c < 3; c++ {
+			out.Pix[i+c] = uint8(clampf(rgb[c], 0, 1)*255 + 0.5)
+		}
+	}
+
+	return out
+}
+
+func (l *LUT) lookup(pos [3]float32) [3]float32 {
+	var lo, hi [3]int
+	var frac [3]float32
+
+	for c := 0; c < 3; c++ {
+		lo[c] = int(pos[c])
+		hi[c] = lo[c] + 1
+		if hi[c] >= l.Size {
+			hi[c] = l.Size - 1
+		}
+		frac[c] = pos[c] - float32(lo[c])
+	}
+
+	at := func(r, g, b int) [3]float32 {
+		return l.Table[r+g*l.Size+b*l.Size*l.Size]
+	}
+
+	var out [3]float32
+	for c := 0; c < 3; c++ {
+		c00 := lerp(at(lo[0], lo[1], lo[2])[c], at(hi[0], lo[1], lo[2])[c], frac[0])
+		c10 := lerp(at(lo[0], hi[1], lo[2])[c], at(hi[0], hi[1], lo[2])[c], frac[0])
+		c01 := lerp(at(lo[0], lo[1], hi[2])[c], at(hi[0], lo[1], hi[2])[c], frac[0])
+		c11 := lerp(at(lo[0], hi[1], hi[2])[c], at(hi[0], hi[1], hi[2])[c], frac[0])
+
+		out[c] = lerp(lerp(c00, c10, frac[1]), lerp(c01, c11, frac[1]), frac[2])
+	}
+
+	return out
+}
+
+func lerp(a, b, t float32) float32 {
+	return a + (b-a)*t
+}
+
+func clampf(v, min, max float32) float32 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
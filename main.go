@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -8,7 +9,9 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -16,186 +19,1839 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/chai2010/webp"
-	"github.com/disintegration/imaging"
 	"golang.org/x/sync/semaphore"
 )
 
 var (
-	quality   = flag.Float64("quality", 80, "quality to use when encoding into webp or jpeg")
-	lossless  = flag.Bool("lossless", false, "whether to encode webp in lossless mode")
-	parallel  = flag.Int("parallel", runtime.NumCPU(), "maximum number of images to process in parallel")
-	quiet     = flag.Bool("quiet", false, "if true, only errors will be printed")
-	outFolder = flag.String("outDir", "", "folder to store output files on, by default they will be stored besides the original file")
-	ifNewer   = flag.Bool("ifNewer", false, "only encode an image if the output image doesn't exist or it's older than the original image")
-
-	sizes = []Size{{480, defaultFormat}, {720, defaultFormat}, {1080, defaultFormat}}
-	jobs  = make(chan *Job, 100)
+	quality             = flag.Float64("quality", 80, "quality to use when encoding into webp or jpeg")
+	lossless            = flag.Bool("lossless", false, "whether to encode webp in lossless mode")
+	parallel            = flag.Int("parallel", runtime.NumCPU(), "maximum number of images to process in parallel")
+	quiet               = flag.Bool("quiet", false, "if true, only errors will be printed")
+	outFolder           = flag.String("outDir", "", "folder to store output files on, by default they will be stored besides the original file")
+	ifNewer             = flag.Bool("ifNewer", false, "only encode an image if the output image doesn't exist or it's older than the original image")
+	lutPath             = flag.String("lut", "", "path to a .cube file or Hald CLUT image to color grade images with before resizing")
+	widthSteps          = flag.String("widthSteps", "", "generate sizes every step pixels of width between min and max, in the form min..max:step")
+	formats             = flag.String("formats", defaultFormat, "comma-separated list of formats to encode the sizes generated by -widthSteps into")
+	srcRoot             = flag.String("srcRoot", "", "if set, output files are stored in outDir mirroring the directory structure of the sources relative to this folder. Accepts a comma-separated list of folders, each source is made relative to the innermost one containing it")
+	dedupe              = flag.Bool("hardlinkDupes", false, "after processing, replace output files with identical contents with hardlinks to a single copy")
+	reportOut           = flag.String("jobReport", "", "path to a CSV file to write per-job stage timings and output sizes to")
+	negotiate           = flag.Bool("negotiationSidecar", false, "write a JSON file per source listing its variants in the order a server should prefer them for content negotiation")
+	negotiationOrder    = flag.String("negotiationOrder", "avif,webp,jpeg,png", "comma-separated format preference order used by -negotiationSidecar")
+	pauseMem            = flag.Uint64("pauseBelowMem", 0, "if set, only one image is processed at a time while the available system memory in MB is below this value")
+	resumeMem           = flag.Uint64("resumeAboveMem", 0, "available system memory in MB required to resume processing in parallel after -pauseBelowMem kicked in, defaults to -pauseBelowMem")
+	minAspect           = flag.Float64("minAspect", 0, "skip images whose width/height ratio is lower than this value")
+	maxAspect           = flag.Float64("maxAspect", 0, "skip images whose width/height ratio is higher than this value")
+	encodeRetries       = flag.Int("encodeRetries", 0, "number of times to retry a failed encode with a lower quality before giving up")
+	retryQualityStep    = flag.Float64("retryQualityStep", 10, "amount the quality is lowered by on every retry when -encodeRetries is set")
+	contactSheet        = flag.String("dirContactSheet", "", "instead of resizing, write a grid of labeled thumbnails of all the images to this file, paginated if needed")
+	sheetCols           = flag.Int("cols", 6, "number of columns in the contact sheet")
+	sheetRows           = flag.Int("rows", 8, "number of rows per contact sheet page")
+	sheetCell           = flag.Int("cellSize", 200, "size in pixels of each contact sheet cell")
+	downscaleFilter     = flag.String("downscaleFilter", autoFilter, "resampling filter to use when shrinking images, \"auto\" uses box (area averaging) for reductions of 2x or more and lanczos otherwise")
+	upscaleFilter       = flag.String("upscaleFilter", "lanczos", "resampling filter to use when enlarging images")
+	estimate            = flag.Bool("estimateSizes", false, "encode images without writing them to print the projected size of the outputs")
+	estimateSample      = flag.Float64("estimateSample", 1, "fraction of the images to encode when using -estimateSizes, the rest is extrapolated")
+	targetBpp           = flag.Float64("targetBpp", 0, "if set, pick the highest quality per image that stays within this many bits per pixel, only for lossy formats")
+	lockOutputs         = flag.Bool("lock", false, "hold an exclusive file lock on each output while writing it, so concurrent runs writing to the same folder don't corrupt each other's files")
+	trimTransparent     = flag.Bool("trimTransparent", false, "crop away fully transparent borders before resizing")
+	trimPadding         = flag.Int("trimPadding", 0, "pixels of transparent margin to keep around the image when using -trimTransparent")
+	manifestPath        = flag.String("manifest", "", "path to a JSON file to write the list of sources and their generated variants to")
+	colorMode           = flag.String("placeholderColor", "", "compute the \"average\" or \"dominant\" color of each image and include it in the manifest")
+	maxBuffers          = flag.Int("maxBuffersInFlight", 0, "maximum number of encoded images held in memory at once by options that buffer their output, 0 means no limit besides -parallel")
+	chainResize         = flag.Bool("chainResize", false, "resize each size from the next larger one instead of from the original image, faster but slightly lower quality")
+	blurHashOn          = flag.Bool("blurhash", false, "compute the BlurHash of each image and include it in the manifest")
+	blurHashX           = flag.Int("blurhashX", 4, "number of horizontal BlurHash components, between 1 and 9")
+	blurHashY           = flag.Int("blurhashY", 3, "number of vertical BlurHash components, between 1 and 9")
+	denoiseStrength     = flag.Float64("denoise", 0, "reduce noise before resizing, this also softens fine detail. For the gaussian filter this is the blur sigma, for the median filter the window radius in pixels")
+	denoiseFilter       = flag.String("denoiseFilter", "gaussian", "filter used by -denoise, gaussian or median")
+	deterministic       = flag.Bool("deterministic", false, "fail if an option that can make the output differ between runs with the same inputs and settings is used, see the README")
+	embedPreview        = flag.Bool("embedPreview", false, "embed a small blurred JPEG preview in the XMP metadata of webp outputs, other formats are left as is")
+	previewSize         = flag.Int("previewSize", 32, "maximum width and height of previews embedded with -embedPreview")
+	allOrNothing        = flag.Bool("allOrNothingFreshness", false, "with -ifNewer, regenerate every size of an image if any of them is missing or outdated")
+	verify              = flag.Bool("verify", false, "after processing, check that every output has the dimensions its size implies")
+	adaptiveQuality     = flag.Bool("adaptiveQuality", false, "raise the quality of detailed images and lower it for flat ones, based on their edge density")
+	adaptiveBand        = flag.Float64("adaptiveQualityBand", 10, "maximum amount -adaptiveQuality can move the quality up or down by")
+	splitChannels       = flag.Bool("splitChannels", false, "instead of resizing, write a grayscale PNG of each color and alpha channel of every image, for troubleshooting color issues")
+	formatDirList       = flag.String("formatDir", "", "comma-separated list of format=folder to store outputs of each format on, formats not listed use -outDir")
+	resumePath          = flag.String("resumeManifest", "", "path to a manifest from a previous run, sources it lists with all their variants are skipped if unchanged and carried over to -manifest")
+	shardCount          = flag.Int("shardOutputs", 0, "if set, also write this many manifest shards next to -manifest, each listing a subset of this run's outputs of roughly the same total size")
+	autoOrient          = flag.Bool("autoOrient", false, "rotate and flip images according to their EXIF orientation")
+	rotationPattern     = flag.String("filenameRotation", "", "regular expression matched against file names without extension, its first capture group gives the clockwise rotation to apply in degrees, e.g. _r(90|180|270)$. Takes precedence over -autoOrient")
+	rotationMapping     = flag.String("filenameRotationMap", "", "comma-separated list of text=degrees to translate the text captured by -filenameRotation into a rotation, e.g. cw=90,ccw=270")
+	execHook            = flag.String("exec", "", "command to run on every output after writing it, {file} is replaced with the output path or appended if missing. A non-zero exit fails the image")
+	tiles               = flag.Bool("tiles", false, "instead of resizing, write a Deep Zoom (.dzi) tile pyramid of every image for zoomable viewers")
+	tileSize            = flag.Int("tileSize", 256, "width and height in pixels of the tiles written by -tiles")
+	tileOverlap         = flag.Int("tileOverlap", 0, "pixels each tile written by -tiles extends into its neighbours")
+	tileFormat          = flag.String("tileFormat", defaultFormat, "format to encode the tiles written by -tiles into")
+	matchQuality        = flag.Bool("matchQuality", false, "encode the largest size of each lossy format at -quality and pick the quality of the smaller ones so their SSIM matches it")
+	keepGoing           = flag.Bool("keepGoing", false, "log images that fail to be processed and continue with the rest instead of stopping, the exit status is still non-zero")
+	failureListPath     = flag.String("failureList", "", "path to a file to write the paths of the images that failed to be processed to, one per line, to retry them with -from")
+	fromList            = flag.String("from", "", "path to a file listing images to process one per line, in addition to the ones given as arguments")
+	outArchive          = flag.String("outArchive", "", "path to a .zip, .tar or .tar.gz file to store all outputs in instead of writing them as separate files, entries are named relative to -outDir")
+	minQuality          = flag.Int("minQuality", 0, "lowest quality -targetBpp, -matchQuality and -adaptiveQuality can pick")
+	maxQuality          = flag.Int("maxQuality", 100, "highest quality -targetBpp, -matchQuality and -adaptiveQuality can pick")
+	comment             = flag.String("comment", "", "text to store in the metadata of every output, as a COM segment in jpeg, an iTXt chunk in png and the XMP description in webp. {provenance} is replaced with how the output was produced")
+	keepExt             = flag.Bool("followOriginalFormatExtension", false, "when an output has the same format as its source, use the extension of the source with its spelling and case, e.g. .JPG instead of .jpeg")
+	cssImageSet         = flag.Bool("cssImageSet", false, "write a CSS file per source with a rule that picks between its variants using image-set()")
+	cssSelector         = flag.String("cssSelector", ".{name}", "selector of the rules written by -cssImageSet and -atlasMap css, {name} is replaced with the source file name without extension")
+	cssProperty         = flag.String("cssProperty", "background-image", "property set by the rules written by -cssImageSet")
+	dedupePerceptual    = flag.Bool("detectDuplicatesPerceptual", false, "skip images that look the same as an image processed earlier in the run according to a perceptual hash, the manifest maps them to its outputs")
+	dedupeDistance      = flag.Int("duplicateDistance", 10, "maximum number of differing bits out of 64 between the perceptual hashes of two images for -detectDuplicatesPerceptual to consider them duplicates")
+	sharpen             = flag.Float64("sharpen", 0, "sigma of the sharpening applied to outputs after resizing, 0 disables it")
+	pickSmallest        = flag.Bool("pickSmallest", false, "for sizes listed with several formats, encode all of them and only write the smallest")
+	validateFirst       = flag.Bool("validateFirst", false, "check that every image can be decoded and passes -allowTypes and -maxPixels before writing anything, and stop without writing if any doesn't")
+	allowTypes          = flag.String("allowTypes", "", "comma-separated list of image types to accept, e.g. jpeg,png, by default every supported type is")
+	maxPixels           = flag.Int64("maxPixels", 0, "reject images with more than this many pixels, to guard against decompression bombs")
+	resizeMode          = flag.String("mode", modeFit, "how sizes given as widthxheight are applied: fit scales the image to fit inside the box, fill covers the box and crops the rest, pad fits the image and fills the rest of the box with -background")
+	anchor              = flag.String("anchor", "center", "part of the image kept when cropping with -mode fill: center, top, bottom, left, right, topleft, topright, bottomleft or bottomright, relative to the image after -autoOrient and -filenameRotation")
+	background          = flag.String("background", "", "color in the form #rrggbb or #rrggbbaa to fill the padding of -mode pad with, transparent by default. jpeg outputs of transparent images are flattened over it, or over white if it isn't opaque")
+	padBlurred          = flag.Bool("padBlurredSource", false, "with -mode pad, fill the padding with a blurred copy of the image scaled to cover the box instead of -background")
+	animFrame           = flag.String("animFrame", animFirst, "frame of animated GIFs to use: first, middle, last or representative, the one closest to the average of all frames")
+	sinceGit            = flag.String("sinceGit", "", "only process images that changed since this git ref, including uncommitted and untracked ones. Every image is processed if git fails, e.g. outside of a repository")
+	jpegExt             = flag.String("jpegExtension", "", "extension of jpeg outputs, jpg or jpeg, by default the one used to name the format in -size")
+	reportSizeUsage     = flag.Bool("reportUnusedSizes", false, "after processing, print for how many images each size was produced, to find sizes that are rarely or never used")
+	frontendBundle      = flag.Bool("frontendBundle", false, "write a JSON file per source with what a frontend lazy loader needs, a tiny placeholder, its color and the variants with their dimensions")
+	frontendFields      = flag.String("frontendFields", "dimensions,lqip,color,variants", "comma-separated list of fields to include in -frontendBundle files: dimensions, lqip, color, blurhash and variants")
+	throttleSpec        = flag.String("throttle", "", "limit how often outputs start being processed, in the form rate[:burst] with rate in outputs per second, see the README")
+	serveAddr           = flag.String("serve", "", "instead of processing files, serve the images in the first source root on this address, resizing them on demand to the size given by the size query parameter in the format negotiated from the Accept header, see the README")
+	baseline            = flag.String("baseline", "", "after writing, compare every output with the file at the same path relative to outDir in this folder, failing if any is missing or differs")
+	baselineMode        = flag.String("baselineMode", "hash", "how outputs are compared with -baseline, hash requires identical files and ssim a minimum similarity")
+	baselineMinSSIM     = flag.Float64("baselineMinSSIM", 0.99, "with -baselineMode ssim, the SSIM under which an output differs from the baseline")
+	maxDecodes          = flag.Int("maxConcurrentDecodes", 0, "maximum number of images decoded at once, 0 means -parallel")
+	maxEncodes          = flag.Int("maxConcurrentEncodes", 0, "maximum number of encoder calls running at once, 0 means no limit besides -parallel")
+	printResolved       = flag.Bool("printConfig", false, "print the configuration resulting from every option, the expanded sizes and the files to process as JSON and exit")
+	optimizeUI          = flag.Bool("optimizeUi", false, "encode images that look like screenshots of user interfaces losslessly, as lossless webp or png reduced to a palette, see -uiMaxColors")
+	uiMaxColors         = flag.Int("uiMaxColors", 4096, "maximum number of distinct colors of an image for -optimizeUi to consider it a UI")
+	qualityMapPath      = flag.String("qualityMap", "", "CSV file of path,quality rows overriding -quality for the images whose path matches, paths may be globs")
+	toSRGB              = flag.Bool("convertToSrgb", false, "convert images with an embedded color profile like Display P3 or Adobe RGB to sRGB, outputs are always written without a profile")
+	manifestSchema      = flag.Bool("printManifestSchema", false, "print the JSON Schema of the file written by -manifest and exit")
+	orderedOutput       = flag.Bool("orderedOutput", false, "print messages about each image, write job report rows and list manifest sources in the order the images were given, holding back output until the images before are done")
+	byteBudget          = flag.Int64("setByteBudget", 0, "maximum total size in KB of all the outputs of each image, the lossy ones are encoded at the highest quality that fits, overriding -quality and -qualityMap. The quality is picked per image and shared by all its lossy outputs")
+	probe               = flag.Bool("probe", false, "instead of processing, print the format, dimensions, color model, EXIF orientation and color profile of every image")
+	probeFormat         = flag.String("probeFormat", "table", "how -probe prints image information, table or json")
+	decodeOnly          = flag.Bool("decodeOnly", false, "only decode every image, without resizing or writing anything, and log how long each decode took, see also -jobReport")
+	aspectTolerance     = flag.Float64("aspectTolerance", 0.01, "with -mode fill, fit images whose aspect ratio differs from the box by at most this fraction instead of cropping them, 0 always crops")
+	logFormat           = flag.String("logFormat", "text", "format of the log, text or json for one JSON object per event with its attributes as fields")
+	posterizeLevels     = flag.Int("posterize", 0, "reduce every color channel of outputs to this many levels for a stylized look, 0 disables it")
+	dirPrefix           = flag.Bool("dirPrefix", false, "store outputs directly in outDir, prefixing their names with the folder of their source relative to srcRoot or the current folder to avoid collisions, e.g. gallery_sub_photo-720p.webp")
+	dirPrefixSep        = flag.String("dirPrefixSeparator", "_", "text joining the folder names prefixed by -dirPrefix")
+	benchFilters        = flag.Bool("benchmarkFilters", false, "instead of processing, resize the first image to the first size with every resampling filter and print how long each took, the encoded size and the SSIM against lanczos")
+	dryRunManifest      = flag.Bool("dryRunManifest", false, "write the manifest the run would produce to -manifest, or stdout if not set, without decoding or writing any image, byte sizes are left out")
+	minSavings          = flag.Float64("minSavings", 0, "only replace an existing output if the new one is at least this percentage smaller, otherwise keep the old file")
+	priorityGlobs       = flag.String("priority", "", "comma-separated list of globs of images to process before the rest, e.g. **/hero-*.jpg")
+	onlyIfSmaller       = flag.String("onlyIfSmaller", "", "only write outputs smaller than their source, otherwise skip them, or copy the source in their place if they have its dimensions: skip or copy")
+	decodedCacheMB      = flag.Int64("maxDecodedCacheMB", 0, "with -serve, keep up to this many MB of decoded images in memory so that unchanged sources aren't decoded again for every size, 0 disables it")
+	resizeInfo          = flag.Bool("resizeAlgorithmInfo", false, "list how each variant was produced in the manifest: the resampling filter, the quality or whether it's lossless and the version of the tool")
+	alphaLossless       = flag.Bool("alphaAwareLossless", false, "encode webp outputs of images with transparent pixels losslessly, avoiding artifacts around transparent edges, and the rest as lossy")
+	formatParallel      = flag.String("formatParallel", "", "comma-separated format=n list capping how many encodes of each format run at once, unlisted formats are only limited by -parallel and -maxConcurrentEncodes")
+	skipHashesPath      = flag.String("skipHashes", "", "file of perceptual hashes, one per line in hex optionally followed by a name, images whose hash is within -skipHashDistance bits of one of them are skipped")
+	skipHashDistance    = flag.Int("skipHashDistance", 10, "maximum number of differing bits out of 64 for -skipHashes to skip an image")
+	srcset              = flag.Bool("srcset", false, "write an HTML file per source with a picture element that picks between its variants using srcset")
+	srcsetMode          = flag.String("srcsetMode", "width", "descriptors used by -srcset, width (720w) or density (2x) relative to the smallest variant")
+	mtimeFromExif       = flag.Bool("mtimeFromExif", false, "set the modification time of outputs to when the photo was taken according to its EXIF DateTimeOriginal, or to the modification time of the source if it has none")
+	maxOutputsPerSource = flag.Int("maxOutputsPerSource", 0, "guard against runaway configurations by checking that no image plans more than this many outputs, see -outputLimitAction, 0 disables it")
+	outputLimitAction   = flag.String("outputLimitAction", "fail", "what to do with images over -maxOutputsPerSource: fail, which stops the run unless -keepGoing is set, or warn and process them anyway")
+	progressJSON        = flag.String("progressJson", "", "stream progress events as newline-delimited JSON to this file, - for stdout or a number for an open file descriptor: start, image, variant, error and summary")
+	smartCropOn         = flag.Bool("smartCrop", false, "with -mode fill, keep the most detailed part of images when cropping instead of the one given by -anchor, trimming the sides with the least entropy first")
+	outListPath         = flag.String("outList", "", "path to a text file to write the path of every output written to, one per line, e.g. to feed to rsync")
+	matchSourceQuality  = flag.Bool("matchSourceQuality", false, "cap the quality of jpeg outputs of jpeg images at the quality they were saved at, estimated from their quantization tables")
+	tolerant            = flag.Bool("tolerant", false, "salvage truncated jpeg images by decoding the part of them that is there, the rest is left gray and they are marked as recovered in the manifest")
+	timeBudgetFlag      = flag.Duration("timeBudget", 0, "if the run is projected to take longer than this, e.g. 10m, encode the remaining outputs in cheaper formats according to -downgradeLadder")
+	downgradeLadder     = flag.String("downgradeLadder", "webp=jpg", "comma-separated from=to list of the format to encode outputs in instead of each format once over -timeBudget")
+	atlas               = flag.String("atlas", "", "instead of resizing, pack all the images into a sprite sheet written to this file, with a map of where each one is next to it")
+	atlasMap            = flag.String("atlasMap", "json", "format of the map written next to the -atlas sprite sheet, json or css")
+	atlasSpriteSize     = flag.Int("atlasSpriteSize", 0, "fit the images packed by -atlas within this many pixels wide and high, 0 keeps their size")
+	atlasPadding        = flag.Int("atlasPadding", 1, "pixels left empty between the images packed by -atlas")
+	atlasMaxSize        = flag.Int("atlasMaxSize", 4096, "maximum width and height in pixels of the -atlas sprite sheet")
+	readTimeout         = flag.Duration("readTimeout", 0, "fail an image if opening and reading it takes longer than this, e.g. 30s, to not hang on misbehaving network storage")
+	formatMapPath       = flag.String("formatMap", "", "CSV file of path,format rows overriding the format of every size for the images whose path matches, paths may be globs")
+	fixOrientation      = flag.Bool("fixOrientation", false, "re-save every image upright according to its EXIF orientation, at its original size and in its own format, see the README for the options it sets")
+	diffImages          = flag.Bool("diffImage", false, "for quality checks, decode every output back and write the difference from the resized image it was encoded from next to it as <output>.diff.png, stretched so the largest difference is white")
+	nameByHash          = flag.Bool("nameByHash", false, "name every output after the SHA-256 of its contents, like <hash>.webp, for content-addressed stores, the manifest maps sources and sizes to them")
+	pipelinePath        = flag.String("pipeline", "", "JSON file listing the steps images are processed with in order, with params overriding their options, see the README")
+	componentSnippet    = flag.Bool("componentSnippet", false, "write an HTML or JSX snippet per source with a picture element listing its variants, their dimensions and a placeholder, see -snippetFlavor and -snippetPlaceholder")
+	snippetFlavor       = flag.String("snippetFlavor", "html", "flavor of the -componentSnippet files, html or jsx")
+	snippetPlaceholder  = flag.String("snippetPlaceholder", "lqip", "placeholder shown by -componentSnippet while the image loads: lqip, blurhash, color or none")
+	snippetTemplatePath = flag.String("snippetTemplate", "", "Go text/template file rendered by -componentSnippet instead of the built-in template of -snippetFlavor, see the README")
+
+	sizes    = []Size{{Height: 480, Format: defaultFormat}, {Height: 720, Format: defaultFormat}, {Height: 1080, Format: defaultFormat}}
+	sizesSet bool
+	jobs     = newJobQueue(100)
+
+	colorLUT     *LUT
+	jobReport    *JobReport
+	outputs               = &OutputList{}
+	sources               = &SourceInfos{}
+	outFS        OutputFS = osFS{}
+	srcFS        fs.FS    = osFS{}
+	bufferSem    *semaphore.Weighted
+	encodeSem    *semaphore.Weighted
+	formatSems   = make(map[string]*semaphore.Weighted)
+	formatDirs   = make(map[string]string)
+	resume       *ResumeIndex
+	rotationRule *RotationRule
+	qualityMap   *QualityMap
+	formatMap    *FormatMap
+	denylist     *HashDenylist
+	ordered      *OrderedOutput
+	failures     *FailureList
+	srcRoots     []string
+	claims       = &OutputClaims{}
+	duplicates   map[string]string
 )
 
-type Job struct {
-	img      image.Image
-	size     Size
-	outPath  string
-	origPath string
-}
+type Job struct {
+	img      image.Image
+	size     Size
+	outPath  string
+	origPath string
+
+	decodeTime time.Duration
+	complexity float64
+
+	// With -matchSourceQuality, the estimated quality of JPEG sources, 0 for
+	// other sources.
+	sourceQuality float64
+
+	// For SVG sources, the parsed image, which outputs are rasterized from
+	// instead of resizing img.
+	svg *svgSource
+
+	// When chaining resizes, the job whose resized image is used as the source
+	// for this one. done is closed once resized is set.
+	parent  *Job
+	resized image.Image
+	done    chan struct{}
+
+	// With -pickSmallest, the formats to try for this size. size and outPath
+	// are set to the ones of the smallest once it's encoded.
+	candidates []plannedVariant
+
+	// When matching quality, the job whose SSIM this one is encoded to match.
+	// measured is closed once ssim is set, which is 0 if it couldn't be measured.
+	qualityRef *Job
+	ssim       float64
+	measured   chan struct{}
+
+	// With -setByteBudget, the quality picked for the job if hasQuality is set,
+	// and the output image rendered while picking it.
+	quality    float64
+	hasQuality bool
+	rendered   image.Image
+
+	// How the output was produced, set once it's about to be encoded.
+	provenance Provenance
+
+	// With -nameByHash, the SHA-256 of the output, set once it's encoded.
+	hash string
+}
+
+// dimensions returns the dimensions of the output of the job.
+func (j *Job) dimensions() (int, int) {
+	return j.size.Dimensions(j.img.Bounds().Dx(), j.img.Bounds().Dy())
+}
+
+// unblock closes done and measured if the job stopped before closing them, so
+// that the jobs waiting on them don't wait forever. Only the job closes them.
+func (j *Job) unblock() {
+	for _, ch := range []chan struct{}{j.done, j.measured} {
+		if ch == nil {
+			continue
+		}
+
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+}
+
+const defaultFormat = "webp"
+
+func main() {
+	flag.Func("size", "comma-separated list of size-format, where size is a height, widthxheight or sxFACTORxsyFACTOR to scale each axis, optionally followed by :sharp=sigma to override -sharpen, :posterize=levels to override -posterize and :ar=w:h to crop to an aspect ratio. Can be repeated to add more sizes (default 480-webp,720-webp,1080-webp)", func(s string) error {
+		// The first -size replaces the default sizes and the rest add to them
+		if !sizesSet {
+			sizes, sizesSet = nil, true
+		}
+
+		for _, p := range strings.Split(s, ",") {
+			s, err := parseSize(p)
+			if err != nil {
+				return err
+			}
+
+			sizes = append(sizes, s)
+		}
+
+		return nil
+	})
+	flag.Parse()
+
+	switch *logFormat {
+	case logFormatText:
+	case logFormatJSON:
+		structuredLog = &jsonLog{w: os.Stderr}
+		log.SetFlags(0)
+		log.SetOutput(structuredLog)
+	default:
+		log.Fatalf("invalid log format %s, must be text or json", *logFormat)
+	}
+
+	if *manifestSchema {
+		if err := printManifestSchema(); err != nil {
+			log.Fatalf("failed to print manifest schema: %s", err)
+		}
+		return
+	}
+
+	if *deterministic {
+		// A retry lowers the quality of the output, and whether one happens depends
+		// on transient encoder failures rather than on the input
+		if *encodeRetries > 0 {
+			log.Fatalf("-encodeRetries can't be used with -deterministic")
+		}
+
+		// Archive entries are added in the order jobs finish, and stamped with the current time
+		if *outArchive != "" {
+			log.Fatalf("-outArchive can't be used with -deterministic")
+		}
+
+		// Which outputs are downgraded depends on how fast the machine is
+		if *timeBudgetFlag > 0 {
+			log.Fatalf("-timeBudget can't be used with -deterministic")
+		}
+	}
+
+	if *onlyIfSmaller != "" && *onlyIfSmaller != largerSkip && *onlyIfSmaller != largerCopy {
+		log.Fatalf("invalid -onlyIfSmaller action %s, must be skip or copy", *onlyIfSmaller)
+	}
+
+	if *minSavings > 0 && (*execHook != "" || *outArchive != "") {
+		log.Fatalf("-minSavings can't be used with -exec or -outArchive")
+	}
+
+	if *nameByHash && (*ifNewer || *resumePath != "" || *negotiate || *cssImageSet || *srcset || *onlyIfSmaller != "" || *minSavings > 0 || *execHook != "") {
+		log.Fatalf("-nameByHash can't be used with -ifNewer, -resumeManifest, -negotiationSidecar, -cssImageSet, -srcset, -onlyIfSmaller, -minSavings or -exec")
+	}
+	if *diffImages && (*outArchive != "" || *estimate) {
+		log.Fatalf("-diffImage can't be used with -outArchive or -estimate")
+	}
+	// Outputs stamped with an earlier time than their source would never be up to date
+	if *mtimeFromExif && (*ifNewer || *outArchive != "") {
+		log.Fatalf("-mtimeFromExif can't be used with -ifNewer or -outArchive")
+	}
+
+	if *maxOutputsPerSource < 0 {
+		log.Fatalf("maximum number of outputs per source can't be negative")
+	}
+	if *outputLimitAction != "fail" && *outputLimitAction != "warn" {
+		log.Fatalf("invalid -outputLimitAction %s, must be fail or warn", *outputLimitAction)
+	}
+
+	if *dirPrefix && *outFolder == "" {
+		log.Fatalf("-dirPrefix requires -outDir")
+	}
+	if strings.ContainsAny(*dirPrefixSep, `/\`) {
+		log.Fatalf("invalid -dirPrefixSeparator %s, can't contain path separators", *dirPrefixSep)
+	}
+
+	if err := checkPosterize(*posterizeLevels); err != nil {
+		log.Fatalf("invalid posterize: %s", err)
+	}
+
+	if *denoiseFilter != "gaussian" && *denoiseFilter != "median" {
+		log.Fatalf("invalid denoise filter %s, must be gaussian or median", *denoiseFilter)
+	}
+
+	if *formatDirList != "" {
+		for _, entry := range strings.Split(*formatDirList, ",") {
+			eq := strings.IndexRune(entry, '=')
+			if eq == -1 {
+				log.Fatalf("invalid format folder %s, expected format=folder", entry)
+			}
+
+			formatDirs[normalizeFormat(entry[:eq])] = entry[eq+1:]
+		}
+	}
+
+	if *shardCount < 0 {
+		log.Fatalf("number of output shards can't be negative")
+	}
+	if *shardCount > 0 && *manifestPath == "" {
+		log.Fatalf("-shardOutputs requires -manifest")
+	}
+
+	if *rotationPattern != "" {
+		var err error
+		rotationRule, err = parseRotationRule(*rotationPattern, *rotationMapping)
+		if err != nil {
+			log.Fatalf("invalid file name rotation: %s", err)
+		}
+	}
+
+	if len(*comment) > maxCommentLength {
+		log.Fatalf("comment can't be longer than %d bytes", maxCommentLength)
+	}
+
+	if *minQuality < 0 || *maxQuality > 100 || *minQuality > *maxQuality {
+		log.Fatalf("invalid quality range %d-%d, must be within 0-100 with -minQuality not above -maxQuality", *minQuality, *maxQuality)
+	}
+
+	if *pickSmallest && (*matchQuality || *targetBpp > 0 || *negotiate || *cssImageSet || *srcset) {
+		log.Fatalf("-pickSmallest can't be used with -matchQuality, -targetBpp, -negotiationSidecar, -cssImageSet or -srcset")
+	}
+
+	if *srcsetMode != srcsetWidth && *srcsetMode != srcsetDensity {
+		log.Fatalf("invalid srcset mode %s, must be width or density", *srcsetMode)
+	}
+
+	if *byteBudget > 0 && (*matchQuality || *targetBpp > 0 || *adaptiveQuality || *pickSmallest) {
+		log.Fatalf("-setByteBudget can't be used with -matchQuality, -targetBpp, -adaptiveQuality or -pickSmallest")
+	}
+
+	if *matchQuality && *targetBpp > 0 {
+		log.Fatalf("-matchQuality can't be used with -targetBpp")
+	}
+
+	if *resizeMode != modeFit && *resizeMode != modeFill && *resizeMode != modePad {
+		log.Fatalf("invalid mode %s, must be fit, fill or pad", *resizeMode)
+	}
+	if _, ok := anchors[*anchor]; !ok {
+		log.Fatalf("invalid anchor %s", *anchor)
+	}
+	if *smartCropOn && *anchor != "center" {
+		log.Fatalf("-smartCrop can't be used with -anchor")
+	}
+	if *background != "" {
+		c, err := parseColor(*background)
+		if err != nil {
+			log.Fatalf("invalid background: %s", err)
+		}
+		backgroundColor = c
+	}
+
+	if *baselineMode != baselineHash && *baselineMode != baselineSSIM {
+		log.Fatalf("invalid baseline mode %s, must be hash or ssim", *baselineMode)
+	}
+
+	if *optimizeUI && *resumePath != "" {
+		log.Fatalf("-optimizeUi can't be used with -resumeManifest")
+	}
+
+	if *jpegExt != "" && *jpegExt != "jpg" && *jpegExt != "jpeg" {
+		log.Fatalf("invalid jpeg extension %s, must be jpg or jpeg", *jpegExt)
+	}
+
+	switch *animFrame {
+	case animFirst, animMiddle, animLast, animRepresentative:
+	default:
+		log.Fatalf("invalid animation frame %s, must be first, middle, last or representative", *animFrame)
+	}
+
+	if *frontendBundle {
+		if err := parseBundleFields(*frontendFields); err != nil {
+			log.Fatalf("invalid frontend bundle fields: %s", err)
+		}
+	}
+
+	if *componentSnippet {
+		switch *snippetPlaceholder {
+		case "lqip", "blurhash", "color", "none":
+		default:
+			log.Fatalf("invalid snippet placeholder %s, must be lqip, blurhash, color or none", *snippetPlaceholder)
+		}
+		if err := loadSnippetTemplate(*snippetTemplatePath, *snippetFlavor); err != nil {
+			log.Fatalf("failed to load snippet template: %s", err)
+		}
+	}
+
+	if *colorMode != "" && *colorMode != "average" && *colorMode != "dominant" {
+		log.Fatalf("invalid placeholder color mode %s, must be average or dominant", *colorMode)
+	}
+
+	for _, f := range []string{*downscaleFilter, *upscaleFilter} {
+		if err := checkFilter(f); err != nil {
+			log.Fatalf("invalid resampling filter: %s", err)
+		}
+	}
+
+	if *fixOrientation {
+		if *outFolder == "" && *outArchive == "" {
+			log.Fatalf("-fixOrientation requires -outDir or -outArchive, the outputs would overwrite their sources otherwise")
+		}
+		if err := applyFixOrientation(); err != nil {
+			log.Fatalf("can't use -fixOrientation: %s", err)
+		}
+	}
+
+	if *widthSteps != "" {
+		steps, err := parseWidthSteps(*widthSteps, strings.Split(*formats, ","))
+		if err != nil {
+			log.Fatalf("failed to parse width steps: %s", err)
+		}
+
+		// Replace the default sizes unless they were explicitly set
+		if sizesSet {
+			sizes = append(sizes, steps...)
+		} else {
+			sizes = steps
+		}
+	}
+
+	if *lutPath != "" {
+		var err error
+		colorLUT, err = loadLUT(*lutPath)
+		if err != nil {
+			log.Fatalf("failed to load LUT %s: %s", *lutPath, err)
+		}
+	}
+
+	if *skipHashesPath != "" {
+		var err error
+		denylist, err = loadHashDenylist(*skipHashesPath)
+		if err != nil {
+			log.Fatalf("failed to load hash denylist %s: %s", *skipHashesPath, err)
+		}
+	}
+
+	if *skipHashDistance < 0 || *skipHashDistance > 64 {
+		log.Fatalf("hash distance must be within 0-64")
+	}
+
+	if *qualityMapPath != "" {
+		var err error
+		qualityMap, err = loadQualityMap(*qualityMapPath)
+		if err != nil {
+			log.Fatalf("failed to load quality map %s: %s", *qualityMapPath, err)
+		}
+	}
+
+	if *pipelinePath != "" {
+		var err error
+		pipeline, err = loadPipeline(*pipelinePath)
+		if err != nil {
+			log.Fatalf("failed to load pipeline %s: %s", *pipelinePath, err)
+		}
+	}
+
+	if *formatMapPath != "" {
+		var err error
+		formatMap, err = loadFormatMap(*formatMapPath)
+		if err != nil {
+			log.Fatalf("failed to load format map %s: %s", *formatMapPath, err)
+		}
+	}
+
+	if *reportOut != "" {
+		var err error
+		jobReport, err = newJobReport(*reportOut)
+		if err != nil {
+			log.Fatalf("failed to create job report: %s", err)
+		}
+	}
+
+	files := make([]string, 0, flag.NArg())
+	for _, f := range flag.Args() {
+		fs, err := expandGlob(f)
+		if err != nil {
+			log.Fatalf("failed to glob files: %s", f)
+		}
+
+		files = append(files, fs...)
+	}
+
+	if *serveAddr != "" {
+		if *outFolder == "" {
+			log.Fatalf("-serve requires -outDir")
+		}
+		if *outArchive != "" || *estimate {
+			log.Fatalf("-serve can't be used with -outArchive or -estimate")
+		}
+
+		// Mirror the folders of the served images in the output folder
+		if *srcRoot == "" {
+			*srcRoot = "."
+		}
+	}
+
+	if *srcRoot != "" {
+		for _, r := range strings.Split(*srcRoot, ",") {
+			abs, err := filepath.Abs(r)
+			if err != nil {
+				log.Fatalf("failed to resolve source root %s: %s", r, err)
+			}
+
+			srcRoots = append(srcRoots, abs)
+		}
+	}
+
+	if *fromList != "" {
+		listed, err := readFileList(*fromList)
+		if err != nil {
+			log.Fatalf("failed to read file list: %s", err)
+		}
+
+		files = append(files, listed...)
+	}
+
+	files = uniqueFiles(files)
+
+	if *printResolved {
+		if err := printConfig(files); err != nil {
+			log.Fatalf("failed to print configuration: %s", err)
+		}
+		return
+	}
+
+	if *dryRunManifest {
+		if err := printPlannedManifest(files); err != nil {
+			log.Fatalf("failed to plan manifest: %s", err)
+		}
+		return
+	}
+
+	{
+		var err error
+		failures, err = newFailureList(*failureListPath)
+		if err != nil {
+			log.Fatalf("failed to create failure list: %s", err)
+		}
+	}
+
+	if *progressJSON != "" {
+		var err error
+		progress, err = openProgressStream(*progressJSON)
+		if err != nil {
+			log.Fatalf("failed to open progress output %s: %s", *progressJSON, err)
+		}
+	}
+
+	if *resumePath != "" {
+		var err error
+		resume, err = loadResumeIndex(*resumePath)
+		if err != nil {
+			log.Fatalf("failed to load manifest to resume: %s", err)
+		}
+	}
+
+	var archive *archiveFS
+	if *outArchive != "" && !*estimate {
+		if *dedupe || *verify || *execHook != "" || *baseline != "" {
+			log.Fatalf("-outArchive can't be used with -hardlinkDupes, -verify, -exec or -baseline")
+		}
+
+		var err error
+		archive, err = newArchiveFS(*outArchive)
+		if err != nil {
+			log.Fatalf("failed to create archive: %s", err)
+		}
+		outFS = archive
+	}
+
+	if *maxBuffers > 0 {
+		bufferSem = semaphore.NewWeighted(int64(*maxBuffers))
+	}
+	if *maxEncodes > 0 {
+		encodeSem = semaphore.NewWeighted(int64(*maxEncodes))
+	}
+	if *formatParallel != "" {
+		for _, entry := range strings.Split(*formatParallel, ",") {
+			eq := strings.IndexRune(entry, '=')
+			if eq == -1 {
+				log.Fatalf("invalid format limit %s, expected format=n", entry)
+			}
+
+			n, err := strconv.Atoi(entry[eq+1:])
+			if err != nil || n <= 0 {
+				log.Fatalf("invalid format limit %s, n must be a positive number", entry)
+			}
+			formatSems[normalizeFormat(entry[:eq])] = semaphore.NewWeighted(int64(n))
+		}
+	}
+
+	if *serveAddr != "" {
+		if err := serveImages(*serveAddr); err != nil {
+			log.Fatalf("failed to serve images: %s", err)
+		}
+		return
+	}
+
+	totalFiles := len(files)
+	if *estimate {
+		if *estimateSample <= 0 {
+			log.Fatalf("estimate sample must be greater than 0")
+		}
+
+		outFS = discardFS{}
+		files = sampleFiles(files, *estimateSample)
+	}
+
+	if *probe {
+		if *probeFormat != "table" && *probeFormat != "json" {
+			log.Fatalf("invalid probe format %s, must be table or json", *probeFormat)
+		}
+		if err := probeImages(files, *probeFormat); err != nil {
+			log.Fatalf("failed to print image information: %s", err)
+		}
+		return
+	}
+
+	if *benchFilters {
+		if len(files) > 1 {
+			log.Printf("benchmarking filters with %s only", files[0])
+		}
+		if err := benchmarkFilters(files[0], sizes[0]); err != nil {
+			log.Fatalf("failed to benchmark filters: %s", err)
+		}
+		return
+	}
+
+	if *contactSheet != "" {
+		if err := writeContactSheets(files, *contactSheet); err != nil {
+			log.Fatalf("failed to write contact sheet: %s", err)
+		}
+		return
+	}
+
+	if *atlas != "" {
+		if err := writeAtlas(files, *atlas); err != nil {
+			log.Fatalf("failed to write atlas: %s", err)
+		}
+		return
+	}
+
+	if *tiles {
+		if *tileSize <= 0 || *tileOverlap < 0 {
+			log.Fatalf("tile size must be greater than 0 and overlap can't be negative")
+		}
+		if err := writeTiles(files); err != nil {
+			log.Fatalf("failed to write tiles: %s", err)
+		}
+		return
+	}
+
+	if *splitChannels {
+		if err := writeChannels(files); err != nil {
+			log.Fatalf("failed to split channels: %s", err)
+		}
+		return
+	}
+
+	if *sinceGit != "" {
+		changed, err := gitChangedFiles(*sinceGit)
+		if err != nil {
+			log.Printf("warning: processing every image, couldn't list the files changed since %s: %s", *sinceGit, err)
+		} else {
+			all := len(files)
+			files = filterChanged(files, changed)
+
+			if !*quiet {
+				log.Printf("%d of %d images changed since %s", len(files), all, *sinceGit)
+			}
+		}
+	}
+
+	if *readTimeout < 0 {
+		log.Fatalf("-readTimeout can't be negative")
+	}
+	if *readTimeout > 0 {
+		srcFS = timeoutFS{fs: osFS{}, timeout: *readTimeout}
+	}
+
+	if *validateFirst {
+		if n := validateInputs(srcFS, files); n > 0 {
+			log.Fatalf("%d images failed validation, nothing was written", n)
+		}
+	}
+
+	if *dedupePerceptual {
+		duplicates = findPerceptualDuplicates(files, *dedupeDistance)
+
+		unique := files[:0]
+		for _, f := range files {
+			if _, ok := duplicates[f]; !ok {
+				unique = append(unique, f)
+			}
+		}
+		files = unique
+	}
+
+	if *orderedOutput {
+		ordered = newOrderedOutput(files)
+	}
+
+	if *decodeOnly {
+		decoders := *parallel
+		if *maxDecodes > 0 {
+			decoders = *maxDecodes
+		}
+		decodeAll(files, decoders)
+
+		if jobReport != nil {
+			if err := jobReport.Close(); err != nil {
+				log.Fatalf("failed to write job report: %s", err)
+			}
+		}
+		if err := failures.Close(); err != nil {
+			log.Fatalf("failed to write failure list: %s", err)
+		}
+		if n := failures.Count(); n > 0 {
+			log.Fatalf("%d images failed to be decoded", n)
+		}
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	start := time.Now()
+
+	var throttle *Throttle
+	if *throttleSpec != "" {
+		var err error
+		throttle, err = parseThrottle(*throttleSpec)
+		if err != nil {
+			log.Fatalf("invalid throttle: %s", err)
+		}
+	}
+
+	var governor *MemoryGovernor
+	if *pauseMem > 0 {
+		governor = newMemoryGovernor(*pauseMem<<20, *resumeMem<<20)
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go governor.Monitor(time.Second, stop)
+	}
+
+	if *timeBudgetFlag > 0 {
+		var err error
+		timeBudget, err = newTimeBudget(*timeBudgetFlag, len(files)*len(sizes), *downgradeLadder)
+		if err != nil {
+			log.Fatalf("failed to parse -downgradeLadder: %s", err)
+		}
+	}
+
+	startFields := logFields{"images": len(files), "parallel": *parallel}
+	reportProgress("", "start", startFields)
+	if !*quiet {
+		logEvent("", "start", startFields, "")
+	}
+
+	for i := 0; i < *parallel; i++ {
+		go func() {
+			for {
+				job, ok := jobs.Pop()
+				if !ok {
+					return
+				}
+
+				if throttle != nil {
+					throttle.Wait()
+				}
+				if governor != nil {
+					governor.Acquire()
+				}
+				if err := doJob(job); err != nil {
+					failures.Fail(job.origPath, "failed to process image", err)
+				}
+				if ordered != nil {
+					ordered.Release(job.origPath)
+				}
+				if governor != nil {
+					governor.Release()
+				}
+				wg.Done()
+			}
+		}()
+	}
+
+	scanwg := sync.WaitGroup{}
+	decoders := *parallel
+	if *maxDecodes > 0 {
+		decoders = *maxDecodes
+	}
+	sem := semaphore.NewWeighted(int64(decoders))
+	for _, f := range prioritized(files) {
+		// Acquire before starting each scan so that images are scanned in order,
+		// with the ones matching -priority first
+		sem.Acquire(context.Background(), 1)
+		scanwg.Add(1)
+		go func(f string) {
+			if err := enqueue(srcFS, f, &wg); err != nil {
+				failures.Fail(f, "failed to resize image", err)
+			}
+			if ordered != nil {
+				ordered.Release(f)
+			}
+			sem.Release(1)
+			scanwg.Done()
+		}(f)
+	}
+	scanwg.Wait()
+	jobs.Close()
+
+	wg.Wait()
+
+	if *estimate {
+		printEstimate(outputs.All(), len(files), totalFiles)
+	}
+
+	if *reportSizeUsage {
+		printSizeUsage(outputs.All(), sizes, len(files))
+	}
+
+	if *frontendBundle && !*estimate {
+		if err := writeFrontendBundles(sources, outputs.All()); err != nil {
+			log.Fatalf("failed to write frontend bundles: %s", err)
+		}
+	}
+
+	if *componentSnippet && !*estimate {
+		if err := writeComponentSnippets(sources, outputs.All()); err != nil {
+			log.Fatalf("failed to write component snippets: %s", err)
+		}
+	}
+
+	if *manifestPath != "" {
+		if err := writeManifest(*manifestPath, buildManifest(sources, outputs.All(), resumedSources(), duplicates)); err != nil {
+			log.Fatalf("failed to write manifest: %s", err)
+		}
+
+		if *shardCount > 0 {
+			if err := writeManifestShards(*manifestPath, *shardCount, sources, outputs.All()); err != nil {
+				log.Fatalf("failed to write manifest shards: %s", err)
+			}
+		}
+	}
+
+	if *outListPath != "" {
+		if err := writeOutputList(*outListPath, outputs.All()); err != nil {
+			log.Fatalf("failed to write output list: %s", err)
+		}
+	}
+
+	if *verify && !*estimate {
+		mismatches, err := verifyOutputs(sources, outputs.All())
+		if err != nil {
+			log.Fatalf("failed to verify outputs: %s", err)
+		}
+		if mismatches > 0 {
+			log.Fatalf("%d outputs don't have the expected dimensions", mismatches)
+		}
+	}
+
+	if *baseline != "" && !*estimate {
+		diffs, err := compareBaseline(*baseline, *baselineMode, *baselineMinSSIM, outputs.All())
+		if err != nil {
+			log.Fatalf("failed to compare outputs with the baseline: %s", err)
+		}
+		if diffs > 0 {
+			log.Fatalf("%d outputs differ from the baseline", diffs)
+		}
+	}
+
+	if *dedupe && !*estimate {
+		if err := hardlinkDuplicates(outputs.All()); err != nil {
+			log.Fatalf("failed to deduplicate outputs: %s", err)
+		}
+	}
+
+	if archive != nil {
+		if err := archive.Close(); err != nil {
+			log.Fatalf("failed to write archive: %s", err)
+		}
+	}
+
+	if jobReport != nil {
+		if err := jobReport.Close(); err != nil {
+			log.Fatalf("failed to write job report: %s", err)
+		}
+	}
+
+	end := time.Now()
+	summary := logFields{
+		"images":     len(files),
+		"outputs":    len(outputs.All()),
+		"failed":     failures.Count(),
+		"durationMs": end.Sub(start).Milliseconds(),
+	}
+	reportProgress("", "summary", summary)
+	if !*quiet {
+		logEvent("", "summary", summary, "done in %s", end.Sub(start))
+	}
+
+	if progress != nil {
+		if err := progress.Close(); err != nil {
+			log.Fatalf("failed to write progress: %s", err)
+		}
+	}
+
+	if err := failures.Close(); err != nil {
+		log.Fatalf("failed to write failure list: %s", err)
+	}
+	if n := failures.Count(); n > 0 {
+		log.Fatalf("%d images failed to be processed", n)
+	}
+}
+
+// enqueue reads the image at path from fsys and queues a job for every size that
+// needs to be generated.
+func enqueue(fsys fs.FS, path string, wg interface{ Add(int) }) error {
+	in, err := fsys.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer in.Close()
+
+	if *allowTypes != "" || *maxPixels > 0 {
+		if err := validateInput(fsys, path); err != nil {
+			return err
+		}
+	}
+
+	if *minAspect > 0 || *maxAspect > 0 {
+		cfg, err := decodeConfig(fsys, path)
+		if err != nil {
+			return err
+		}
+
+		aspect := float64(cfg.Width) / float64(cfg.Height)
+		if (*minAspect > 0 && aspect < *minAspect) || (*maxAspect > 0 && aspect > *maxAspect) {
+			if !*quiet {
+				logEvent(path, "skip", logFields{"reason": "aspect", "aspect": aspect}, "skipped image %s with aspect ratio %.2f", path, aspect)
+			}
+			return nil
+		}
+	}
+
+	var img image.Image
+	var svg *svgSource
+	var decodeTime time.Duration
+	var complexity float64
+
+	var srcQuality float64
+	if *matchSourceQuality {
+		srcQuality = sourceQuality(fsys, path)
+	}
+
+	base, err := outputBase(path, "")
+	if err != nil {
+		return err
+	}
+
+	// decode decodes the image and prepares it for resizing on the first call
+	decode := func() error {
+		if img != nil {
+			return nil
+		}
+
+		decodeStart := time.Now()
+		img, err = decodeSource(in, path)
+		if err != nil {
+			return fmt.Errorf("decode image: %w", err)
+		}
+		decodeTime = time.Since(decodeStart)
+
+		// Outputs are rasterized from the SVG image itself, so SVG images that
+		// are transformed are resized like other images instead
+		if !transformsSource() {
+			if svg, err = loadSVG(fsys, path); err != nil {
+				return err
+			}
+		}
+
+		img = prepareSource(img)
+		return nil
+	}
+
+	// load decodes the image and collects its information on the first call
+	loaded := false
+	load := func() error {
+		if loaded {
+			return nil
+		}
+		if err := decode(); err != nil {
+			return err
+		}
+		loaded = true
+
+		info := &SourceInfo{
+			Path:      path,
+			Width:     img.Bounds().Dx(),
+			Height:    img.Bounds().Dy(),
+			Recovered: wasRecovered(path),
+		}
+		if *colorMode != "" {
+			info.Color = placeholderColor(img, *colorMode)
+		} else if bundleWants("color") || snippetWants("color") {
+			info.Color = placeholderColor(img, "dominant")
+		}
+		if bundleWants("lqip") || snippetWants("lqip") {
+			if info.LQIP, err = lqipDataURI(img); err != nil {
+				return fmt.Errorf("encode placeholder: %w", err)
+			}
+		}
+		if *blurHashOn || bundleWants("blurhash") || snippetWants("blurhash") {
+			info.BlurHash, err = blurHash(img, *blurHashX, *blurHashY)
+			if err != nil {
+				return fmt.Errorf("compute blurhash: %w", err)
+			}
+		}
+		if *manifestPath != "" {
+			if fi, err := fs.Stat(fsys, path); err == nil {
+				info.ModTime = fi.ModTime()
+			}
+			if info.Hash, err = sourceHash(fsys, path); err != nil {
+				return fmt.Errorf("hash file: %w", err)
+			}
+		}
+		sources.Add(info)
+
+		if *adaptiveQuality {
+			complexity = edgeDensity(img)
+		}
+		return nil
+	}
+
+	if denylist != nil {
+		if err := decode(); err != nil {
+			return err
+		}
+
+		hash := pHash(img)
+		if name, dist, ok := denylist.Match(hash, *skipHashDistance); ok {
+			if !*quiet {
+				logEvent(path, "skip", logFields{"reason": "denylisted", "hash": fmt.Sprintf("%016x", hash), "match": name, "distance": dist}, "skipped image %s, it matches %s in the denylist", path, name)
+			}
+			return nil
+		}
+	}
+
+	targets := sourceSizes(path, sizes)
+	if *optimizeUI {
+		if err := load(); err != nil {
+			return err
+		}
+
+		if looksLikeUI(img) {
+			if !*quiet {
+				logImage(path, "encoding image %s losslessly as it looks like a UI", path)
+			}
+			targets = uiSizes(targets)
+		}
+	}
+
+	// Only images whose color model has alpha need to be decoded to look for transparency
+	if *alphaLossless && mayHaveAlpha(fsys, path) {
+		if err := load(); err != nil {
+			return err
+		}
+
+		if !isOpaque(img) {
+			if !*quiet {
+				logImage(path, "encoding image %s losslessly as it has transparency", path)
+			}
+			targets = losslessSizes(targets)
+		}
+	}
+
+	var planned []plannedVariant
+	var queued []*Job
+	var freshBytes int64
+
+	for _, size := range targets {
+		newpath, err := variantPath(path, size)
+		if err != nil {
+			return err
+		}
+
+		planned = append(planned, plannedVariant{size, newpath})
+	}
+
+	if *maxOutputsPerSource > 0 && len(planned) > *maxOutputsPerSource {
+		if *outputLimitAction != "warn" {
+			return fmt.Errorf("%d outputs planned, more than -maxOutputsPerSource %d", len(planned), *maxOutputsPerSource)
+		}
+		logImage(path, "warning: %d outputs planned for %s, more than -maxOutputsPerSource %d", len(planned), path, *maxOutputsPerSource)
+	}
+
+	// Outputs named by hash can't overwrite each other
+	if !*nameByHash {
+		for _, v := range planned {
+			if other, ok := claims.Claim(v.path, path); !ok {
+				logImage(path, "warning: %s and %s both produce %s, only one of them will be kept", other, path, v.path)
+			}
+		}
+	}
+
+	if resume != nil && resume.Skip(fsys, path, planned) {
+		if !*quiet {
+			logEvent(path, "skip", logFields{"reason": "resumed"}, "skipped image %s, it's unchanged since the resumed manifest", path)
+		}
+		return nil
+	}
+
+	// Check if the output images are up to date
+	fresh := make([]bool, len(planned))
+	if *ifNewer {
+		for i, v := range planned {
+			fresh[i] = isUpToDate(fsys, path, v.path)
+		}
+
+		// Only one of the candidate formats of a size is written
+		if *pickSmallest {
+			groupFresh := make(map[Size]bool)
+			for i, v := range planned {
+				groupFresh[v.size.withoutFormat()] = groupFresh[v.size.withoutFormat()] || fresh[i]
+			}
+			for i, v := range planned {
+				fresh[i] = groupFresh[v.size.withoutFormat()]
+			}
+		}
+
+		stale := false
+		for _, f := range fresh {
+			stale = stale || !f
+		}
+
+		// Keep the variants of an image consistent with each other by regenerating all of them
+		if stale && *allOrNothing {
+			fresh = make([]bool, len(planned))
+		}
+	}
+
+	for i, v := range planned {
+		size, newpath := v.size, v.path
+
+		if fresh[i] {
+			if fi, err := outFS.Stat(newpath); err == nil {
+				freshBytes += fi.Size()
+			}
+
+			if !*quiet {
+				logEvent(path, "skip", logFields{"reason": "upToDate", "output": newpath}, "skipped image %s", newpath)
+			}
+			if timeBudget != nil {
+				timeBudget.Settle()
+			}
+			continue
+		}
+
+		// Lazy load image because we may not need to load it if all sizes are up to date
+		if err := load(); err != nil {
+			return err
+		}
+
+		if *pickSmallest {
+			if job := findCandidateJob(queued, size); job != nil {
+				job.candidates = append(job.candidates, v)
+				continue
+			}
+		}
+
+		queued = append(queued, &Job{
+			candidates: []plannedVariant{v},
+
+			img:      img,
+			size:     size,
+			outPath:  newpath,
+			origPath: path,
+
+			decodeTime:    decodeTime,
+			complexity:    complexity,
+			sourceQuality: srcQuality,
+			svg:           svg,
+		})
+	}
+
+	// SVG outputs are rasterized at their size rather than resized
+	if *chainResize && svg == nil {
+		linkResizeChain(queued)
+	}
+	if *matchQuality {
+		linkQualityReferences(queued)
+	}
+	if *byteBudget > 0 && len(queued) > 0 {
+		if err := fitByteBudget(path, queued, *byteBudget<<10, freshBytes); err != nil {
+			return fmt.Errorf("fit byte budget: %w", err)
+		}
+	}
+
+	imageFields := logFields{"queued": len(queued), "upToDate": len(planned) - len(queued)}
+	reportProgress(path, "image", imageFields)
+	if !*quiet {
+		logEvent(path, "image", imageFields, "")
+	}
+
+	for _, job := range queued {
+		wg.Add(1)
+		if ordered != nil {
+			ordered.Hold(path)
+		}
+		jobs.Push(job, hasPriority(path))
+	}
+
+	if *negotiate {
+		if err := writeNegotiationSidecar(path, base+".negotiation.json", planned); err != nil {
+			return fmt.Errorf("write negotiation sidecar: %w", err)
+		}
+	}
+
+	if *cssImageSet || *srcset {
+		var w, h int
+		if img != nil {
+			w, h = img.Bounds().Dx(), img.Bounds().Dy()
+		} else {
+			cfg, err := decodeConfig(fsys, path)
+			if err != nil {
+				return err
+			}
+			w, h = cfg.Width, cfg.Height
+		}
+
+		if *cssImageSet {
+			if err := writeCSSImageSet(path, base+".css", planned, w, h); err != nil {
+				return fmt.Errorf("write image-set css: %w", err)
+			}
+		}
+		if *srcset {
+			if err := writeSrcset(base+".html", planned, w, h); err != nil {
+				return fmt.Errorf("write srcset: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// variantPath returns the path of the output of the image at path with size.
+func variantPath(path string, size Size) (string, error) {
+	base, err := outputBase(path, size.Format)
+	if err != nil {
+		return "", err
+	}
+
+	var newpath string
+	ext := outputExt(path, size.Format)
+	if name := size.Name(); name == "" {
+		newpath = fmt.Sprintf("%s.%s", base, ext)
+	} else {
+		newpath = fmt.Sprintf("%s-%s.%s", base, name, ext)
+	}
+
+	if pathKey(newpath) == pathKey(path) {
+		return "", fmt.Errorf("output %s would overwrite its source", newpath)
+	}
+
+	return newpath, nil
+}
+
+// isUpToDate returns whether the output at outPath exists and is newer than the
+// source image at path.
+func isUpToDate(fsys fs.FS, path, outPath string) bool {
+	outfi, err := outFS.Stat(outPath)
+	if err != nil {
+		return false
+	}
+
+	srcfi, err := fs.Stat(fsys, path)
+	return err == nil && outfi.ModTime().After(srcfi.ModTime())
+}
+
+// decodeConfig returns the color model and dimensions of the image at path
+// after being oriented.
+func decodeConfig(fsys fs.FS, path string) (image.Config, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("decode image config: %w", err)
+	}
+
+	// Report the dimensions of the image as decodeSource orients it
+	swap, err := swapsAxes(fsys, path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if swap {
+		cfg.Width, cfg.Height = cfg.Height, cfg.Width
+	}
+
+	return cfg, nil
+}
+
+// outputBase returns the path without extension that the outputs of the image
+// at path encoded to format are named after.
+func outputBase(path, format string) (string, error) {
+	dir, err := outputDir(path, format)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if *dirPrefix {
+		prefix, err := dirNamePrefix(path)
+		if err != nil {
+			return "", err
+		}
+		name = prefix + name
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// dirNamePrefix returns the folder of path relative to its source root, or the
+// current folder without -srcRoot, as a file name prefix with its components
+// sanitized and joined by -dirPrefixSeparator, e.g. gallery_sub_.
+func dirNamePrefix(path string) (string, error) {
+	rel, err := sourceRelDir(path)
+	if err != nil {
+		return "", err
+	}
+
+	var prefix strings.Builder
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if part == "." || part == ".." || part == "" {
+			continue
+		}
+
+		prefix.WriteString(strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+				return r
+			}
+			return '_'
+		}, part))
+		prefix.WriteString(*dirPrefixSep)
+	}
+
+	return prefix.String(), nil
+}
+
+// outputExt returns the extension of outputs of path encoded to format, which is
+// the format unless -followOriginalFormatExtension is set and the source is in
+// the same format, in which case its extension is kept as is, or -jpegExtension
+// is set for jpeg outputs.
+func outputExt(path, format string) string {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+
+	if *keepExt && normalizeFormat(strings.ToLower(ext)) == normalizeFormat(format) {
+		return ext
+	}
+	if *jpegExt != "" && normalizeFormat(format) == "jpeg" {
+		return *jpegExt
+	}
+	return format
+}
+
+func outputDir(path, format string) (string, error) {
+	root := *outFolder
+	if d, ok := formatDirs[normalizeFormat(format)]; ok {
+		root = d
+	}
+
+	if root == "" {
+		return filepath.Dir(path), nil
+	}
+
+	// Outputs are flattened into the folder with -dirPrefix
+	if *srcRoot == "" || *dirPrefix {
+		return root, nil
+	}
+
+	rel, err := sourceRelDir(path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// sourceRelDir returns the folder of path relative to the innermost source
+// root containing it, or to the current folder if there are none.
+func sourceRelDir(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("resolve path: %w", err)
+	}
+
+	if len(srcRoots) == 0 {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("get working directory: %w", err)
+		}
+		return filepath.Rel(wd, filepath.Dir(abs))
+	}
+
+	// Use the innermost root containing the file, which is the longest one, so
+	// nested roots work too
+	var rel, root string
+	found := false
+	for _, src := range srcRoots {
+		r, err := filepath.Rel(src, filepath.Dir(abs))
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		if !found || len(src) > len(root) {
+			rel, root, found = r, src, true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("file %s is not inside source root %s", path, *srcRoot)
+	}
+
+	return rel, nil
+}
+
+func doJob(job *Job) error {
+	defer job.unblock()
+
+	// Outputs already produced in the cheaper format as their own size are left as they are
+	if timeBudget != nil && len(job.candidates) <= 1 {
+		if format, ok := timeBudget.Downgrade(job.size.Format); ok {
+			size := job.size
+			size.Format = format
+			outPath, err := variantPath(job.origPath, size)
+			if err != nil {
+				return err
+			}
+
+			if claims.ClaimNew(outPath, job.origPath) {
+				logImage(job.origPath, "encoding %s as %s instead of %s to stay within the time budget", job.outPath, format, job.size.Format)
+				job.size, job.outPath = size, outPath
+			}
+		}
+	}
+
+	if !*quiet {
+		logEvent(job.origPath, "resize", logFields{"size": job.size.String(), "format": job.size.Format}, "resizing image %s with size %s encoded to %s", job.origPath, job.size, job.size.Format)
+	}
+
+	timings := JobTimings{Decode: job.decodeTime}
+
+	src := job.img
+	if job.parent != nil {
+		<-job.parent.done
+		if job.parent.resized != nil {
+			src = job.parent.resized
+		}
+	}
+
+	resizeStart := time.Now()
+	newimg := job.img
+	filter := ""
+	if job.size.Name() != "" {
+		w, h := job.dimensions()
+		if job.svg != nil {
+			filter = "vector"
+		} else {
+			filter = resizeFilter(src.Bounds().Dx(), src.Bounds().Dy(), w, h)
+		}
+
+		switch {
+		case job.rendered != nil:
+			// Already resized by fitByteBudget
+			newimg = job.resized
+		case job.svg != nil:
+			src = job.svg.rasterizeForSize(job.size, job.img.Bounds().Dx(), job.img.Bounds().Dy(), w, h)
+			newimg = resizeToSize(src, job.size, w, h)
+		default:
+			newimg = resizeToSize(src, job.size, w, h)
+		}
+	}
+	timings.Resize = time.Since(resizeStart)
+
+	if job.done != nil {
+		job.resized = newimg
+		close(job.done)
+	}
 
-const defaultFormat = "webp"
+	// Sharpen and the rest after handing the image to chained jobs, so they
+	// don't run twice
+	if job.rendered != nil {
+		newimg, job.rendered = job.rendered, nil
+	} else {
+		newimg = finishOutput(newimg, job.size)
+	}
 
-func main() {
-	flag.Func("size", "comma-separated list of size-format (default 480-webp,720-webp,1080-webp)", func(s string) error {
-		parts := strings.Split(s, ",")
-		sizes = make([]Size, len(parts))
+	q := *quality
+	if qualityMap != nil {
+		if mq, ok := qualityMap.Quality(job.origPath); ok {
+			q = mq
+		}
+	}
+	if job.hasQuality {
+		q = job.quality
+	}
+	if *adaptiveQuality && isLossy(job.size) {
+		q = adaptQuality(q, job.complexity, *adaptiveBand)
 
-		for i, p := range parts {
-			s, err := parseSize(p)
+		if !*quiet {
+			logImage(job.origPath, "using quality %g for %s", q, job.outPath)
+		}
+	}
+	if *targetBpp > 0 && isLossy(job.size) {
+		var err error
+		q, err = qualityForBpp(newimg, job.size, *targetBpp)
+		if err != nil {
+			return fmt.Errorf("search quality for %s: %w", job.outPath, err)
+		}
+
+		if !*quiet {
+			logImage(job.origPath, "using quality %g for %s", q, job.outPath)
+		}
+	}
+
+	if job.measured != nil {
+		ssim, err := encodedSSIM(newimg, job.size, q)
+		if err != nil {
+			return fmt.Errorf("measure quality of %s: %w", job.outPath, err)
+		}
+
+		job.ssim = ssim
+		close(job.measured)
+	}
+	if job.qualityRef != nil {
+		<-job.qualityRef.measured
+
+		if job.qualityRef.ssim > 0 {
+			var err error
+			q, err = qualityForSSIM(newimg, job.size, job.qualityRef.ssim)
 			if err != nil {
-				return err
+				return fmt.Errorf("search quality for %s: %w", job.outPath, err)
+			}
+
+			if !*quiet {
+				logImage(job.origPath, "using quality %g for %s to match SSIM %.4f", q, job.outPath, job.qualityRef.ssim)
 			}
+		}
+	}
 
-			sizes[i] = s
+	// Re-encoding a JPEG at a higher quality than it was saved at only adds bytes
+	if job.sourceQuality > 0 && normalizeFormat(job.size.Format) == "jpeg" && q > job.sourceQuality {
+		q = job.sourceQuality
+
+		if !*quiet {
+			logImage(job.origPath, "using quality %g for %s, the quality of its source", q, job.outPath)
 		}
+	}
 
-		return nil
-	})
-	flag.Parse()
+	job.provenance = provenanceFor(job.size, filter, q)
 
-	files := make([]string, 0, flag.NArg())
-	for _, f := range flag.Args() {
-		fs, err := filepath.Glob(f)
+	encodeStart := time.Now()
+
+	// Encoded ahead of writing when the output has to be compared with others
+	var encoded []byte
+	if len(job.candidates) > 1 {
+		acquireBuffer()
+		defer releaseBuffer()
+
+		var err error
+		encoded, err = encodeSmallest(job, newimg, q)
 		if err != nil {
-			log.Fatalf("failed to glob files: %s", f)
+			return fmt.Errorf("encode file %s: %w", job.outPath, err)
 		}
 
-		files = append(files, fs...)
+		if !*quiet {
+			logImage(job.origPath, "picked %s for %s as the smallest format", job.size.Format, job.outPath)
+		}
 	}
 
-	wg := sync.WaitGroup{}
-	start := time.Now()
+	if *onlyIfSmaller != "" {
+		if encoded == nil {
+			acquireBuffer()
+			defer releaseBuffer()
 
-	for i := 0; i < *parallel; i++ {
-		go func() {
-			for job := range jobs {
-				if err := doJob(job); err != nil {
-					log.Fatalf("failed to process image: %s", err)
-				}
-				wg.Done()
+			var err error
+			if encoded, err = encodeBuffered(newimg, job.size, q, commentFor(job.provenance)); err != nil {
+				return fmt.Errorf("encode file %s: %w", job.outPath, err)
 			}
-		}()
+		}
+
+		if fi, err := fs.Stat(srcFS, job.origPath); err == nil && int64(len(encoded)) >= fi.Size() {
+			timings.Encode = time.Since(encodeStart)
+			return useSourceInstead(job, newimg, int64(len(encoded)), timings)
+		}
 	}
 
-	scanwg := sync.WaitGroup{}
-	sem := semaphore.NewWeighted(int64(*parallel))
-	for _, f := range files {
-		scanwg.Add(1)
-		go func(f string) {
-			sem.Acquire(context.Background(), 1)
-			if err := enqueue(f, &wg); err != nil {
-				log.Fatalf("failed to resize image: %s", err)
+	if *minSavings > 0 {
+		if fi, err := outFS.Stat(job.outPath); err == nil {
+			if encoded == nil {
+				acquireBuffer()
+				defer releaseBuffer()
+
+				if encoded, err = encodeBuffered(newimg, job.size, q, commentFor(job.provenance)); err != nil {
+					return fmt.Errorf("encode file %s: %w", job.outPath, err)
+				}
 			}
-			sem.Release(1)
-			scanwg.Done()
-		}(f)
+
+			savings := 100 * float64(fi.Size()-int64(len(encoded))) / float64(fi.Size())
+			if savings < *minSavings {
+				if !*quiet {
+					logEvent(job.origPath, "skip", logFields{"reason": "minSavings", "output": job.outPath, "savings": savings}, "kept %s, the new output would only save %.1f%%", job.outPath, savings)
+				}
+
+				timings.Encode = time.Since(encodeStart)
+				timings.Bytes = fi.Size()
+				finishJob(job, newimg, timings)
+				return nil
+			}
+
+			if !*quiet {
+				logImage(job.origPath, "replacing %s, the new output saves %.1f%%", job.outPath, savings)
+			}
+		}
 	}
-	scanwg.Wait()
-	close(jobs)
 
-	wg.Wait()
+	if *nameByHash {
+		if encoded == nil {
+			acquireBuffer()
+			defer releaseBuffer()
 
-	end := time.Now()
-	if !*quiet {
-		log.Printf("done in %s", end.Sub(start))
+			var err error
+			if encoded, err = encodeBuffered(newimg, job.size, q, commentFor(job.provenance)); err != nil {
+				return fmt.Errorf("encode file %s: %w", job.outPath, err)
+			}
+		}
+
+		path, hash, written, err := hashedPath(job, encoded)
+		if err != nil {
+			return err
+		}
+		job.outPath, job.hash = path, hash
+
+		if written {
+			if !*quiet {
+				logImage(job.origPath, "%s is already stored", job.outPath)
+			}
+
+			timings.Encode = time.Since(encodeStart)
+			timings.Bytes = int64(len(encoded))
+			finishJob(job, newimg, timings)
+			return nil
+		}
 	}
-}
 
-func enqueue(path string, wg interface{ Add(int) }) error {
-	in, err := os.Open(path)
+	out, err := outFS.Create(job.outPath)
 	if err != nil {
-		return fmt.Errorf("open file: %w", err)
+		return fmt.Errorf("create file %s: %w", job.outPath, err)
 	}
-	defer in.Close()
+	defer out.Close() // Just in case
 
-	var img image.Image
+	cw := &countingWriter{w: out}
+	if encoded != nil {
+		_, err = cw.Write(encoded)
+	} else {
+		err = encodeOutput(cw, newimg, job.size, q, commentFor(job.provenance))
+	}
+	if err != nil {
+		return fmt.Errorf("encode file %s: %w", job.outPath, err)
+	}
+	timings.Encode = time.Since(encodeStart)
+	timings.Bytes = cw.n
 
-	for _, size := range sizes {
-		var newpath string
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("write file %s: %w", job.outPath, err)
+	}
 
-		var dir string
-		if *outFolder == "" {
-			dir = filepath.Dir(path)
-		} else {
-			dir = *outFolder
+	if *execHook != "" && !*estimate {
+		if err := runHook(*execHook, job.outPath); err != nil {
+			return fmt.Errorf("post-process file %s: %w", job.outPath, err)
 		}
-		base := filepath.Join(dir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
 
-		if size.Height == 0 {
-			newpath = fmt.Sprintf("%s.%s", base, size.Format)
-		} else {
-			newpath = fmt.Sprintf("%s-%dp.%s", base, size.Height, size.Format)
-		}
-
-		// Check if the output image is up to date
-		if *ifNewer {
-			outfi, err := os.Stat(newpath)
-			if err == nil {
-				srcfi, err := os.Stat(path)
-				if err == nil && outfi.ModTime().After(srcfi.ModTime()) {
-					if !*quiet {
-						log.Printf("skipped image %s", newpath)
-					}
-					continue
-				}
-			}
+		// The command may have rewritten the file, e.g. to optimize it
+		if fi, err := outFS.Stat(job.outPath); err == nil {
+			timings.Bytes = fi.Size()
 		}
+	}
 
-		// Lazy load image because we may not need to load it if all sizes are up to date
-		if img == nil {
-			img, _, err = image.Decode(in)
-			if err != nil {
-				return fmt.Errorf("decode image: %w", err)
-			}
+	if *diffImages {
+		largest, err := writeDiffImage(newimg, job.size, job.outPath)
+		if err != nil {
+			return fmt.Errorf("write difference image of %s: %w", job.outPath, err)
 		}
 
-		wg.Add(1)
-		jobs <- &Job{
-			img:      img,
-			size:     size,
-			outPath:  newpath,
-			origPath: path,
+		if !*quiet {
+			logImage(job.origPath, "wrote difference image %s, the largest difference is %d", diffImagePath(job.outPath), largest)
 		}
 	}
 
+	if *mtimeFromExif && !*estimate {
+		if err := stampCaptureTime(job.origPath, job.outPath); err != nil {
+			return err
+		}
+	}
+
+	finishJob(job, newimg, timings)
 	return nil
 }
 
-func doJob(job *Job) error {
-	if !*quiet {
-		log.Printf("resizing image %s with size %d encoded to %s", job.origPath, job.size.Height, job.size.Format)
-	}
+// finishJob records the output of job, resized to img and timings.Bytes long.
+func finishJob(job *Job, img image.Image, timings JobTimings) {
+	outputs.Add(Output{
+		Source: job.origPath,
+		Path:   job.outPath,
+		Format: job.size.Format,
+		Size:   job.size,
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+		Bytes:  timings.Bytes,
+		Hash:   job.hash,
 
-	w, h := job.img.Bounds().Dx(), job.img.Bounds().Dy()
+		Provenance: job.provenance,
+	})
 
-	var newimg image.Image
-	if job.size.Height == 0 {
-		newimg = job.img
-	} else {
-		newimg = imaging.Resize(job.img, calcWidth(w, h, job.size.Height), job.size.Height, imaging.Lanczos)
+	fields := logFields{
+		"output":     job.outPath,
+		"size":       job.size.String(),
+		"format":     job.size.Format,
+		"width":      img.Bounds().Dx(),
+		"height":     img.Bounds().Dy(),
+		"bytes":      timings.Bytes,
+		"durationMs": (timings.Resize + timings.Encode).Milliseconds(),
+	}
+	if timeBudget != nil {
+		timeBudget.Settle()
+	}
+
+	reportProgress(job.origPath, "variant", fields)
+	if !*quiet {
+		logEvent(job.origPath, "variant", fields, "")
 	}
 
-	os.MkdirAll(filepath.Dir(job.outPath), os.ModePerm)
+	reportJob(job, timings)
+}
 
-	out, err := os.Create(job.outPath)
+// stampCaptureTime sets the modification time of the output at path to when the
+// photo at source was taken, or to the modification time of source if it
+// doesn't say.
+func stampCaptureTime(source, path string) error {
+	in, err := srcFS.Open(source)
 	if err != nil {
-		return fmt.Errorf("create file %s: %w", job.outPath, err)
+		return fmt.Errorf("open file: %w", err)
 	}
-	defer out.Close() // Just in case
+	defer in.Close()
 
-	if err := encode(out, newimg, job.size.Format); err != nil {
-		return fmt.Errorf("encode file %s: %w", job.outPath, err)
+	t, ok := exifCaptureTime(in)
+	if !ok {
+		fi, err := in.Stat()
+		if err != nil {
+			return fmt.Errorf("stat file: %w", err)
+		}
+		t = fi.ModTime()
 	}
 
-	out.Close()
+	if err := os.Chtimes(path, t, t); err != nil {
+		return fmt.Errorf("set modification time of %s: %w", path, err)
+	}
 	return nil
 }
 
@@ -203,40 +1859,376 @@ func calcWidth(w, h, newh int) int {
 	return int((float32(w) / float32(h)) * float32(newh))
 }
 
-func encode(w io.Writer, img image.Image, format string) error {
-	switch format {
+// encodeOutput encodes img into w with comment as its -comment. The output is
+// buffered in memory when the encode may be retried or metadata has to be added
+// to it, so that a failed attempt doesn't leave partial data in w.
+func encodeOutput(w io.Writer, img image.Image, size Size, quality float64, comment string) error {
+	if *encodeRetries <= 0 && !hasMetadata(size.Format) {
+		return encode(w, img, size, quality)
+	}
+
+	acquireBuffer()
+	defer releaseBuffer()
+
+	data, err := encodeBuffered(img, size, quality, comment)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// encodeBuffered encodes img in memory the way encodeOutput does. The caller
+// must hold a buffer from acquireBuffer.
+func encodeBuffered(img image.Image, size Size, quality float64, comment string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeWithRetries(&buf, img, size, quality); err != nil {
+		return nil, err
+	}
+
+	data, err := addMetadata(buf.Bytes(), img, size.Format, comment)
+	if err != nil {
+		return nil, fmt.Errorf("add metadata: %w", err)
+	}
+	return data, nil
+}
+
+// encodeWithRetries encodes img into buf, retrying with a lower quality if the
+// encoder fails and -encodeRetries is set.
+func encodeWithRetries(buf *bytes.Buffer, img image.Image, size Size, quality float64) error {
+	for attempt := 0; ; attempt++ {
+		err := encode(buf, img, size, quality)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= *encodeRetries || quality-*retryQualityStep < 0 {
+			return err
+		}
+
+		quality -= *retryQualityStep
+		buf.Reset()
+
+		log.Printf("failed to encode image to %s (%s), retrying with quality %g", size.Format, err, quality)
+	}
+}
+
+func resumedSources() []*ManifestSource {
+	if resume == nil {
+		return nil
+	}
+	return resume.Skipped()
+}
+
+// acquireBuffer must be called before buffering an encoded image in memory,
+// blocking if -maxBuffersInFlight images are already buffered.
+func acquireBuffer() {
+	if bufferSem != nil {
+		bufferSem.Acquire(context.Background(), 1)
+	}
+}
+
+func releaseBuffer() {
+	if bufferSem != nil {
+		bufferSem.Release(1)
+	}
+}
+
+// encode encodes img to the format of size. The quality is ignored by lossless encodes.
+func encode(w io.Writer, img image.Image, size Size, quality float64) error {
+	if encodeSem != nil {
+		encodeSem.Acquire(context.Background(), 1)
+		defer encodeSem.Release(1)
+	}
+	if sem, ok := formatSems[normalizeFormat(size.Format)]; ok {
+		sem.Acquire(context.Background(), 1)
+		defer sem.Release(1)
+	}
+
+	switch size.Format {
 	case "webp":
-		return webp.Encode(w, img, &webp.Options{Lossless: *lossless, Quality: float32(*quality)})
+		return webp.Encode(w, img, &webp.Options{Lossless: size.lossless(), Quality: float32(quality)})
 	case "jpeg", "jpg":
-		return jpeg.Encode(w, img, &jpeg.Options{Quality: int(*quality)})
+		return jpeg.Encode(w, flatten(img), &jpeg.Options{Quality: int(quality)})
 	case "png":
+		if size.Quantize {
+			img = quantize(img)
+		}
 		return png.Encode(w, img)
 	}
 
-	return fmt.Errorf("unknown format %s", format)
+	return fmt.Errorf("unknown format %s", size.Format)
 }
 
 type Size struct {
+	Width  int
 	Height int
 	Format string
+
+	// Sharpen overrides the global -sharpen if HasSharpen is set.
+	Sharpen    float64
+	HasSharpen bool
+
+	// ScaleX and ScaleY, if set, scale each axis of the source independently
+	// instead, which distorts it unless they are equal.
+	ScaleX float64
+	ScaleY float64
+
+	// Posterize overrides the global -posterize if HasPosterize is set.
+	Posterize    int
+	HasPosterize bool
+
+	// AspectW and AspectH, if set, crop outputs of this height to that aspect
+	// ratio, regardless of -mode.
+	AspectW int
+	AspectH int
+
+	// Lossless encodes webp losslessly regardless of -lossless, Quantize reduces
+	// png to a palette. Both are set by -optimizeUi.
+	Lossless bool
+	Quantize bool
+}
+
+// lossless returns whether webp outputs of this size are lossless.
+func (s Size) lossless() bool {
+	return *lossless || s.Lossless
+}
+
+// withoutFormat returns the size with an empty format, to compare the
+// dimensions and options of sizes.
+func (s Size) withoutFormat() Size {
+	s.Format = ""
+	return s
+}
+
+// sharpen returns the sharpening sigma to apply to outputs of this size.
+func (s Size) sharpen() float64 {
+	if s.HasSharpen {
+		return s.Sharpen
+	}
+	return *sharpen
+}
+
+// posterize returns the number of levels per channel outputs of this size are
+// reduced to, or 0 if they aren't.
+func (s Size) posterize() int {
+	if s.HasPosterize {
+		return s.Posterize
+	}
+	return *posterizeLevels
+}
+
+// Name returns the suffix used for output file names, or an empty string if
+// the image is kept at its original size.
+func (s Size) Name() string {
+	switch {
+	case s.hasAspect():
+		return fmt.Sprintf("%dp-%dx%d", s.Height, s.AspectW, s.AspectH)
+	case s.isScale():
+		return fmt.Sprintf("sx%gxsy%g", s.ScaleX, s.ScaleY)
+	case s.isBox():
+		return fmt.Sprintf("%dx%d", s.Width, s.Height)
+	case s.Width != 0:
+		return fmt.Sprintf("%dw", s.Width)
+	case s.Height != 0:
+		return fmt.Sprintf("%dp", s.Height)
+	}
+
+	return ""
+}
+
+// Dimensions returns the size of an image of w by h pixels after resizing it to s.
+func (s Size) Dimensions(w, h int) (int, int) {
+	switch {
+	case s.hasAspect():
+		return s.aspectBox()
+	case s.isScale():
+		return maxInt(1, int(math.Round(float64(w)*s.ScaleX))), maxInt(1, int(math.Round(float64(h)*s.ScaleY)))
+	case s.isBox():
+		if s.mode(w, h) == modeFit {
+			return fitDimensions(w, h, s.Width, s.Height)
+		}
+		return s.Width, s.Height
+	case s.Width != 0:
+		return s.Width, calcWidth(h, w, s.Width)
+	case s.Height != 0:
+		return calcWidth(w, h, s.Height), s.Height
+	}
+
+	return w, h
+}
+
+func (s Size) String() string {
+	if name := s.Name(); name != "" {
+		return name
+	}
+
+	return "original"
 }
 
+// parseSize parses a size in the form height[-format][:option=value...]. The
+// options are sharp, which sets the sharpening sigma of the size, posterize,
+// which sets its levels per channel, and ar, which crops it to an aspect ratio
+// like 16:9.
 func parseSize(str string) (Size, error) {
+	parts := strings.Split(str, ":")
+
+	size, err := parseSizeFormat(parts[0])
+	if err != nil {
+		return Size{}, err
+	}
+
+	opts := parts[1:]
+	for i := 0; i < len(opts); i++ {
+		opt := opts[i]
+		eq := strings.IndexRune(opt, '=')
+		if eq == -1 {
+			return Size{}, fmt.Errorf("invalid size option %s, expected name=value", opt)
+		}
+
+		switch name, value := opt[:eq], opt[eq+1:]; name {
+		case "sharp":
+			sigma, err := strconv.ParseFloat(value, 64)
+			if err != nil || sigma < 0 {
+				return Size{}, fmt.Errorf("invalid sharpening %s", value)
+			}
+
+			size.Sharpen, size.HasSharpen = sigma, true
+
+		case "posterize":
+			levels, err := strconv.Atoi(value)
+			if err != nil {
+				return Size{}, fmt.Errorf("invalid posterize %s", value)
+			}
+			if err := checkPosterize(levels); err != nil {
+				return Size{}, err
+			}
+
+			size.Posterize, size.HasPosterize = levels, true
+
+		case "ar":
+			// The ratio is split from its option by the option separator
+			if i+1 < len(opts) && !strings.ContainsRune(opts[i+1], '=') {
+				i++
+				value += ":" + opts[i]
+			}
+
+			colon := strings.IndexRune(value, ':')
+			if colon == -1 {
+				return Size{}, fmt.Errorf("invalid aspect ratio %s, expected width:height", value)
+			}
+			aw, werr := strconv.Atoi(value[:colon])
+			ah, herr := strconv.Atoi(value[colon+1:])
+			if werr != nil || herr != nil || aw <= 0 || ah <= 0 {
+				return Size{}, fmt.Errorf("invalid aspect ratio %s, expected width:height", value)
+			}
+			if size.isBox() || size.isScale() {
+				return Size{}, fmt.Errorf("aspect ratio %s can only be set on sizes with just a height", value)
+			}
+
+			size.AspectW, size.AspectH = aw, ah
+
+		default:
+			return Size{}, fmt.Errorf("unknown size option %s", name)
+		}
+	}
+
+	return size, nil
+}
+
+func parseSizeFormat(str string) (Size, error) {
 	dash := strings.IndexRune(str, '-')
 
-	if dash == -1 {
-		size, err := strconv.Atoi(str)
+	format := defaultFormat
+	if dash != -1 {
+		str, format = str[:dash], str[dash+1:]
+	}
+
+	if strings.HasPrefix(str, "sx") {
+		return parseScaleSize(str, format)
+	}
+
+	// Either a height or a box in the form widthxheight
+	if x := strings.IndexRune(str, 'x'); x != -1 {
+		w, err := strconv.Atoi(str[:x])
+		if err != nil {
+			return Size{}, fmt.Errorf("parse %s: %w", str[:x], err)
+		}
+		h, err := strconv.Atoi(str[x+1:])
 		if err != nil {
-			return Size{}, fmt.Errorf("parse %s: %w", str, err)
+			return Size{}, fmt.Errorf("parse %s: %w", str[x+1:], err)
+		}
+		if w <= 0 || h <= 0 {
+			return Size{}, fmt.Errorf("invalid box %s, both dimensions must be greater than 0", str)
 		}
 
-		return Size{size, defaultFormat}, nil
+		return Size{Width: w, Height: h, Format: format}, nil
+	}
+
+	size, err := strconv.Atoi(str)
+	if err != nil {
+		return Size{}, fmt.Errorf("parse %s: %w", str, err)
+	}
+
+	return Size{Height: size, Format: format}, nil
+}
+
+// parseScaleSize parses a size in the form sxFACTORxsyFACTOR, which scales the
+// width and the height of sources by each factor.
+func parseScaleSize(str, format string) (Size, error) {
+	x := strings.Index(str, "xsy")
+	if x == -1 {
+		return Size{}, fmt.Errorf("invalid scale %s, expected sxFACTORxsyFACTOR", str)
+	}
+
+	sx, err := strconv.ParseFloat(str[2:x], 64)
+	if err != nil {
+		return Size{}, fmt.Errorf("parse %s: %w", str[2:x], err)
+	}
+	sy, err := strconv.ParseFloat(str[x+3:], 64)
+	if err != nil {
+		return Size{}, fmt.Errorf("parse %s: %w", str[x+3:], err)
+	}
+	if !(sx > 0) || !(sy > 0) || math.IsInf(sx, 0) || math.IsInf(sy, 0) {
+		return Size{}, fmt.Errorf("invalid scale %s, both factors must be greater than 0", str)
+	}
+
+	return Size{ScaleX: sx, ScaleY: sy, Format: format}, nil
+}
+
+// parseWidthSteps expands an expression like 320..1920:160 into a size for
+// every step between both widths (inclusive) and every format.
+func parseWidthSteps(str string, formats []string) ([]Size, error) {
+	colon := strings.IndexRune(str, ':')
+	dots := strings.Index(str, "..")
+	if colon == -1 || dots == -1 || dots > colon {
+		return nil, fmt.Errorf("invalid width steps %s, expected min..max:step", str)
 	}
 
-	size, err := strconv.Atoi(str[:dash])
+	min, err := strconv.Atoi(str[:dots])
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", str[:dots], err)
+	}
+	max, err := strconv.Atoi(str[dots+2 : colon])
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", str[dots+2:colon], err)
+	}
+	step, err := strconv.Atoi(str[colon+1:])
 	if err != nil {
-		return Size{}, fmt.Errorf("parse %s: %w", str[:dash], err)
+		return nil, fmt.Errorf("parse %s: %w", str[colon+1:], err)
+	}
+
+	if min <= 0 || max < min || step <= 0 {
+		return nil, fmt.Errorf("invalid width steps %s", str)
+	}
+
+	var sizes []Size
+	for w := min; w <= max; w += step {
+		for _, f := range formats {
+			sizes = append(sizes, Size{Width: w, Format: f})
+		}
 	}
 
-	return Size{Height: size, Format: str[dash+1:]}, nil
+	return sizes, nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Manifest describes the source images processed in a run and their variants.
+type Manifest struct {
+	Sources []*ManifestSource `json:"sources"`
+}
+
+type ManifestSource struct {
+	Path     string    `json:"path"`
+	ModTime  time.Time `json:"modTime"`
+	Hash     string    `json:"sha256,omitempty"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Color    string    `json:"color,omitempty"`
+	BlurHash string    `json:"blurhash,omitempty"`
+	// Set for sources that were damaged and only partly decoded with -tolerant.
+	Recovered bool `json:"recovered,omitempty"`
+	// Set for sources that weren't processed because they look the same as
+	// another one, whose variants are listed instead.
+	DuplicateOf string            `json:"duplicateOf,omitempty"`
+	Variants    []ManifestVariant `json:"variants"`
+}
+
+type ManifestVariant struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Size   string `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bytes  int64  `json:"bytes,omitempty"`
+
+	// Set with -nameByHash
+	Hash string `json:"sha256,omitempty"`
+
+	// Set with -resizeAlgorithmInfo
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// SourceInfo holds what is known about a decoded source image.
+type SourceInfo struct {
+	Path          string
+	ModTime       time.Time
+	Hash          string
+	Width, Height int
+	Color         string
+	BlurHash      string
+	LQIP          string
+	Recovered     bool
+}
+
+// SourceInfos collects information about source images, it is safe for concurrent use.
+type SourceInfos struct {
+	mu    sync.Mutex
+	infos map[string]*SourceInfo
+}
+
+func (s *SourceInfos) Add(info *SourceInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.infos == nil {
+		s.infos = make(map[string]*SourceInfo)
+	}
+	s.infos[info.Path] = info
+}
+
+func (s *SourceInfos) Get(path string) *SourceInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.infos[path]
+}
+
+// buildManifest builds a manifest from the outputs of a run, plus the entries
+// of sources that were carried over from a previous manifest and of duplicate
+// sources, which map to the source they duplicate.
+func buildManifest(infos *SourceInfos, outputs []Output, carried []*ManifestSource, duplicates map[string]string) *Manifest {
+	bySource := make(map[string]*ManifestSource)
+	// Start from an empty list so that it is encoded as [] rather than null
+	m := &Manifest{Sources: append([]*ManifestSource{}, carried...)}
+
+	for _, o := range outputs {
+		src, ok := bySource[o.Source]
+		if !ok {
+			src = &ManifestSource{Path: o.Source}
+			if info := infos.Get(o.Source); info != nil {
+				src.ModTime = info.ModTime
+				src.Hash = info.Hash
+				src.Width = info.Width
+				src.Height = info.Height
+				src.Color = info.Color
+				src.BlurHash = info.BlurHash
+				src.Recovered = info.Recovered
+			}
+
+			bySource[o.Source] = src
+			m.Sources = append(m.Sources, src)
+		}
+
+		variant := ManifestVariant{
+			Path:   o.Path,
+			Format: o.Format,
+			Size:   o.Size.String(),
+			Width:  o.Width,
+			Height: o.Height,
+			Bytes:  o.Bytes,
+			Hash:   o.Hash,
+		}
+		if *resizeInfo {
+			p := o.Provenance
+			variant.Provenance = &p
+		}
+		src.Variants = append(src.Variants, variant)
+	}
+
+	for dup, orig := range duplicates {
+		if src, ok := bySource[orig]; ok {
+			m.Sources = append(m.Sources, &ManifestSource{
+				Path:        dup,
+				Width:       src.Width,
+				Height:      src.Height,
+				Color:       src.Color,
+				BlurHash:    src.BlurHash,
+				DuplicateOf: orig,
+				Variants:    src.Variants,
+			})
+		}
+	}
+
+	sort.Slice(m.Sources, func(i, j int) bool {
+		// With -orderedOutput sources follow the input order, and sources that
+		// weren't part of it, like resumed ones, come last
+		if ordered != nil {
+			pi, iok := ordered.Position(m.Sources[i].Path)
+			pj, jok := ordered.Position(m.Sources[j].Path)
+			if iok != jok {
+				return iok
+			}
+			if iok && pi != pj {
+				return pi < pj
+			}
+		}
+		return m.Sources[i].Path < m.Sources[j].Path
+	})
+
+	return m
+}
+
+func writeManifest(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeOutputFile(path, data)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// MemoryGovernor limits the number of active workers to one while the
+// available system memory is below a threshold.
+type MemoryGovernor struct {
+	pauseBelow, resumeAbove uint64
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+	paused bool
+}
+
+func newMemoryGovernor(pauseBelow, resumeAbove uint64) *MemoryGovernor {
+	if resumeAbove < pauseBelow {
+		resumeAbove = pauseBelow
+	}
+
+	g := &MemoryGovernor{pauseBelow: pauseBelow, resumeAbove: resumeAbove}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Acquire blocks until the worker is allowed to process a job. While memory is
+// low a single worker is still allowed to run so that the batch keeps progressing.
+func (g *MemoryGovernor) Acquire() {
+	g.mu.Lock()
+	for g.paused && g.active > 0 {
+		g.cond.Wait()
+	}
+	g.active++
+	g.mu.Unlock()
+}
+
+func (g *MemoryGovernor) Release() {
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+// Monitor polls the available memory every interval until stop is closed.
+func (g *MemoryGovernor) Monitor(interval time.Duration, stop <-chan struct{}) {
+	if _, ok := availableMemory(); !ok {
+		log.Printf("available memory can't be read on this system, not throttling on memory pressure")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		avail, _ := availableMemory()
+
+		g.mu.Lock()
+		switch {
+		case !g.paused && avail < g.pauseBelow:
+			g.paused = true
+			if !*quiet {
+				log.Printf("available memory is low (%d MB), reducing concurrency", avail>>20)
+			}
+
+			// Give back whatever the runtime is holding on to
+			debug.FreeOSMemory()
+
+		case g.paused && avail >= g.resumeAbove:
+			g.paused = false
+			if !*quiet {
+				log.Printf("available memory recovered (%d MB), resuming", avail>>20)
+			}
+		}
+		g.mu.Unlock()
+
+		g.cond.Broadcast()
+	}
+}
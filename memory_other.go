@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func availableMemory() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+)
+
+// previewBlurSigma is how much embedded previews are blurred, which hides the
+// artifacts of their low resolution and makes them compress better.
+const previewBlurSigma = 1
+
+// maxCommentLength is the longest comment that fits in a JPEG COM segment.
+const maxCommentLength = 0xffff - 2
+
+// hasMetadata returns whether metadata has to be added to outputs of format.
+func hasMetadata(format string) bool {
+	switch format {
+	case "webp":
+		return *embedPreview || *comment != ""
+	case "jpeg", "jpg", "png":
+		return *comment != ""
+	}
+
+	return false
+}
+
+// addMetadata adds the configured metadata to data, the encoded form of img,
+// with comment as the expansion of -comment for it.
+func addMetadata(data []byte, img image.Image, format, comment string) ([]byte, error) {
+	if !hasMetadata(format) {
+		return data, nil
+	}
+
+	switch format {
+	case "jpeg", "jpg":
+		return addJPEGComment(data, comment)
+	case "png":
+		return addPNGComment(data, comment)
+	}
+
+	var props bytes.Buffer
+
+	if *embedPreview {
+		thumb := imaging.Blur(imaging.Fit(img, *previewSize, *previewSize, imaging.Box), previewBlurSigma)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 60}); err != nil {
+			return nil, fmt.Errorf("encode preview: %w", err)
+		}
+
+		fmt.Fprintf(&props, xmpThumbnailTemplate, thumb.Bounds().Dx(), thumb.Bounds().Dy(), base64.StdEncoding.EncodeToString(buf.Bytes()))
+	}
+
+	if comment != "" {
+		var text bytes.Buffer
+		xml.EscapeText(&text, []byte(comment))
+
+		fmt.Fprintf(&props, xmpDescriptionTemplate, text.String())
+	}
+
+	return webp.SetMetadata(data, []byte(fmt.Sprintf(xmpTemplate, props.String())), "XMP")
+}
+
+// addJPEGComment inserts a COM segment holding text right after the start of
+// image marker.
+func addJPEGComment(data []byte, text string) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("missing JPEG start of image marker")
+	}
+
+	out := make([]byte, 0, len(data)+4+len(text))
+	out = append(out, data[:2]...)
+	out = append(out, 0xff, 0xfe)
+	out = append(out, byte((len(text)+2)>>8), byte(len(text)+2))
+	out = append(out, text...)
+	out = append(out, data[2:]...)
+
+	return out, nil
+}
+
+// addPNGComment inserts an iTXt chunk with the Comment keyword holding text
+// right after the IHDR chunk.
+func addPNGComment(data []byte, text string) ([]byte, error) {
+	// Signature, then the IHDR chunk: length, type, 13 bytes of data and CRC
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4
+	if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+		return nil, fmt.Errorf("missing PNG IHDR chunk")
+	}
+
+	// Keyword, null separator, no compression, empty language and translated keyword
+	chunk := append([]byte("iTXt"), "Comment\x00\x00\x00\x00\x00"...)
+	chunk = append(chunk, text...)
+
+	var length, crc [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(chunk)-4))
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk))
+
+	out := make([]byte, 0, len(data)+len(chunk)+8)
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, length[:]...)
+	out = append(out, chunk...)
+	out = append(out, crc[:]...)
+	out = append(out, data[ihdrEnd:]...)
+
+	return out, nil
+}
+
+// xmpTemplate is an XMP packet with a single description, whose properties
+// are filled in from the templates below.
+const xmpTemplate = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:xmpGImg="http://ns.adobe.com/xap/1.0/g/img/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+%s  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+// xmpThumbnailTemplate holds a JPEG thumbnail as described by the xmp:Thumbnails
+// property of the XMP basic schema.
+const xmpThumbnailTemplate = `   <xmp:Thumbnails>
+    <rdf:Alt>
+     <rdf:li rdf:parseType="Resource">
+      <xmpGImg:width>%d</xmpGImg:width>
+      <xmpGImg:height>%d</xmpGImg:height>
+      <xmpGImg:format>JPEG</xmpGImg:format>
+      <xmpGImg:image>%s</xmpGImg:image>
+     </rdf:li>
+    </rdf:Alt>
+   </xmp:Thumbnails>
+`
+
+// xmpDescriptionTemplate holds a comment as the default language dc:description.
+const xmpDescriptionTemplate = `   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="x-default">%s</rdf:li>
+    </rdf:Alt>
+   </dc:description>
+`
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NegotiationSidecar lists the variants of a source grouped by size, with the
+// formats of each size in the order a server should try them.
+type NegotiationSidecar struct {
+	Source string            `json:"source"`
+	Sizes  []NegotiationSize `json:"sizes"`
+}
+
+type NegotiationSize struct {
+	Size     string              `json:"size"`
+	Variants []NegotiationFormat `json:"variants"`
+}
+
+type NegotiationFormat struct {
+	Format string `json:"format"`
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+}
+
+type plannedVariant struct {
+	size Size
+	path string
+}
+
+func writeNegotiationSidecar(source, sidecarPath string, variants []plannedVariant) error {
+	dir := filepath.Dir(sidecarPath)
+	sidecar := NegotiationSidecar{Source: source}
+	indexes := make(map[string]int)
+
+	for _, v := range variants {
+		name := v.size.String()
+
+		i, ok := indexes[name]
+		if !ok {
+			i = len(sidecar.Sizes)
+			indexes[name] = i
+			sidecar.Sizes = append(sidecar.Sizes, NegotiationSize{Size: name})
+		}
+
+		rel, err := filepath.Rel(dir, v.path)
+		if err != nil {
+			rel = v.path
+		}
+
+		sidecar.Sizes[i].Variants = append(sidecar.Sizes[i].Variants, NegotiationFormat{
+			Format: v.size.Format,
+			Type:   mimeType(v.size.Format),
+			Path:   filepath.ToSlash(rel),
+		})
+	}
+
+	for _, s := range sidecar.Sizes {
+		variants := s.Variants
+		sort.SliceStable(variants, func(i, j int) bool {
+			return formatRank(variants[i].Format) < formatRank(variants[j].Format)
+		})
+	}
+
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeOutputFile(sidecarPath, data); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+	return nil
+}
+
+// formatRank returns the position of format in -negotiationOrder, formats not
+// listed in it rank last.
+func formatRank(format string) int {
+	order := strings.Split(*negotiationOrder, ",")
+	for i, f := range order {
+		if normalizeFormat(f) == normalizeFormat(format) {
+			return i
+		}
+	}
+	return len(order)
+}
+
+func normalizeFormat(format string) string {
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+func mimeType(format string) string {
+	return "image/" + normalizeFormat(format)
+}
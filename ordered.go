@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// OrderedOutput holds back what is printed about each image until every image
+// before it in the input is complete, so that output follows the input order
+// however jobs are scheduled. It is safe for concurrent use.
+type OrderedOutput struct {
+	mu    sync.Mutex
+	index map[string]int
+
+	// Per input position, the number of pending steps and the output waiting
+	// for the positions before it
+	holds   []int
+	pending [][]func()
+
+	// The first position that isn't complete, its output isn't held back
+	next int
+}
+
+// newOrderedOutput creates an OrderedOutput for files, holding every file until
+// it's released once for each time it appears in files.
+func newOrderedOutput(files []string) *OrderedOutput {
+	o := &OrderedOutput{
+		index:   make(map[string]int),
+		holds:   make([]int, len(files)),
+		pending: make([][]func(), len(files)),
+	}
+
+	for i, f := range files {
+		if _, ok := o.index[f]; !ok {
+			o.index[f] = i
+		}
+		o.holds[o.index[f]]++
+	}
+
+	o.advance()
+	return o
+}
+
+// Hold marks a step of the image at path as pending.
+func (o *OrderedOutput) Hold(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if i, ok := o.index[path]; ok {
+		o.holds[i]++
+	}
+}
+
+// Release marks a step of the image at path as complete, flushing the output
+// of the images that are no longer held back.
+func (o *OrderedOutput) Release(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if i, ok := o.index[path]; ok {
+		o.holds[i]--
+		o.advance()
+	}
+}
+
+// Do runs fn, which outputs something about the image at path, once every
+// image before it is complete.
+func (o *OrderedOutput) Do(path string, fn func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	i, ok := o.index[path]
+	if !ok || i <= o.next {
+		fn()
+		return
+	}
+
+	o.pending[i] = append(o.pending[i], fn)
+}
+
+// Position returns the position of path in the input.
+func (o *OrderedOutput) Position(path string) (int, bool) {
+	i, ok := o.index[path]
+	return i, ok
+}
+
+func (o *OrderedOutput) advance() {
+	for o.next < len(o.holds) {
+		for _, fn := range o.pending[o.next] {
+			fn()
+		}
+		o.pending[o.next] = nil
+
+		if o.holds[o.next] > 0 {
+			return
+		}
+		o.next++
+	}
+}
+
+// inOrder runs fn, which outputs something about the image at path, in input
+// order with -orderedOutput and right away otherwise.
+func inOrder(path string, fn func()) {
+	if ordered == nil {
+		fn()
+		return
+	}
+
+	ordered.Do(path, fn)
+}
+
+// logImage logs a message about the image at path, in input order with -orderedOutput.
+func logImage(path, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	inOrder(path, func() {
+		log.Print(msg)
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// RotationRule rotates images whose file name matches a pattern, by the amount of
+// clockwise degrees given by the first capture group of the pattern.
+type RotationRule struct {
+	re *regexp.Regexp
+
+	// Maps the captured text to degrees, if empty the text must be the degrees.
+	mapping map[string]int
+}
+
+// parseRotationRule parses a pattern and an optional comma-separated list of
+// text=degrees mappings for its first capture group.
+func parseRotationRule(pattern, mapping string) (*RotationRule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("compile pattern: %w", err)
+	}
+	if re.NumSubexp() < 1 {
+		return nil, fmt.Errorf("pattern %s has no capture group", pattern)
+	}
+
+	rule := &RotationRule{re: re, mapping: make(map[string]int)}
+
+	if mapping != "" {
+		for _, entry := range strings.Split(mapping, ",") {
+			eq := strings.IndexRune(entry, '=')
+			if eq == -1 {
+				return nil, fmt.Errorf("invalid mapping %s, expected text=degrees", entry)
+			}
+
+			deg, err := parseDegrees(entry[eq+1:])
+			if err != nil {
+				return nil, err
+			}
+
+			rule.mapping[entry[:eq]] = deg
+		}
+	}
+
+	return rule, nil
+}
+
+func parseDegrees(s string) (int, error) {
+	deg, err := strconv.Atoi(s)
+	if err != nil || deg%90 != 0 {
+		return 0, fmt.Errorf("invalid rotation %s, must be a multiple of 90", s)
+	}
+
+	return ((deg % 360) + 360) % 360, nil
+}
+
+// Match returns the clockwise rotation for the file at path, ok is false if its
+// name doesn't match the rule.
+func (r *RotationRule) Match(path string) (deg int, ok bool, err error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	m := r.re.FindStringSubmatch(name)
+	if m == nil {
+		return 0, false, nil
+	}
+
+	if len(r.mapping) > 0 {
+		deg, ok = r.mapping[m[1]]
+		return deg, ok, nil
+	}
+
+	deg, err = parseDegrees(m[1])
+	if err != nil {
+		return 0, false, fmt.Errorf("file name %s: %w", name, err)
+	}
+
+	return deg, true, nil
+}
+
+// decodeSource decodes the image at path and orients it. A matching -filenameRotation
+// rule takes precedence over the EXIF orientation read with -autoOrient. For
+// animated GIFs the frame picked by -animFrame is decoded. With -convertToSrgb
+// images with a color profile are converted to sRGB.
+func decodeSource(r io.Reader, path string) (image.Image, error) {
+	deg, rotate := 0, false
+	if rotationRule != nil {
+		var err error
+		deg, rotate, err = rotationRule.Match(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Decoders drop the color profile, so read it beforehand
+	var data, profile []byte
+	if *toSRGB || *tolerant {
+		var err error
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+		if *toSRGB {
+			if profile, err = readICCProfile(data); err != nil {
+				return nil, fmt.Errorf("read color profile: %w", err)
+			}
+		}
+		r = bytes.NewReader(data)
+	}
+
+	decode := func(r io.Reader) (image.Image, error) {
+		br := bufio.NewReader(r)
+
+		switch {
+		case *animFrame != animFirst && isGIF(br):
+			return decodeGIFFrame(br, *animFrame)
+		case *autoOrient && !rotate:
+			return imaging.Decode(br, imaging.AutoOrientation(true))
+		default:
+			img, _, err := image.Decode(br)
+			return img, err
+		}
+	}
+
+	img, err := decode(r)
+	if err != nil && *tolerant {
+		if padded, ok := padTruncatedJPEG(data); ok {
+			if recovered, rerr := decode(bytes.NewReader(padded)); rerr == nil {
+				logImage(path, "warning: recovered %s, parts of it may be missing: %s", path, err)
+				recoveredImages.Store(path, true)
+				img, err = recovered, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if profile != nil {
+		img = convertToSRGB(img, profile, path)
+	}
+
+	if rotate {
+		img = rotateClockwise(img, deg)
+	}
+	return img, nil
+}
+
+// swapsAxes returns whether decodeSource turns the image at path sideways, which
+// swaps its width and height.
+func swapsAxes(fsys fs.FS, path string) (bool, error) {
+	if rotationRule != nil {
+		deg, ok, err := rotationRule.Match(path)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return deg == 90 || deg == 270, nil
+		}
+	}
+
+	if !*autoOrient {
+		return false, nil
+	}
+
+	f, err := fsys.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	// Orientations 5 to 8 are transposed or rotated by 90 or 270 degrees
+	return exifOrientation(f) >= 5, nil
+}
+
+func rotateClockwise(img image.Image, deg int) image.Image {
+	switch deg {
+	case 90:
+		return imaging.Rotate270(img)
+	case 180:
+		return imaging.Rotate180(img)
+	case 270:
+		return imaging.Rotate90(img)
+	}
+
+	return img
+}
+
+// fixOrientationOptions are the options -fixOrientation sets unless they are
+// given explicitly.
+var fixOrientationOptions = map[string]string{
+	"autoOrient":                    "true",
+	"quality":                       "95",
+	"followOriginalFormatExtension": "true",
+}
+
+// applyFixOrientation sets up -fixOrientation, which re-saves every image upright
+// at its original size and in its own format.
+func applyFixOrientation() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if set["size"] || *widthSteps != "" {
+		return fmt.Errorf("images are kept at their original size, so -size and -widthSteps can't be set")
+	}
+
+	for name, value := range fixOrientationOptions {
+		if !set[name] {
+			if err := flag.Set(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The format is replaced with that of each source by sourceSizes
+	sizes = []Size{{Format: defaultFormat}}
+	return nil
+}
+
+// sourceFormat returns the format of the image at path from its extension, or
+// png for formats that can't be encoded, so that they are kept losslessly.
+func sourceFormat(path string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	switch normalizeFormat(ext) {
+	case "webp", "jpeg", "png":
+		return ext
+	}
+	return "png"
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	red  = color.NRGBA{0xff, 0, 0, 0xff}
+	blue = color.NRGBA{0, 0, 0xff, 0xff}
+)
+
+// writeRotatedJPEG writes a 400x200 JPEG whose left half is red and right half
+// is blue, tagged with EXIF orientation 6 so that it's displayed rotated 90
+// degrees clockwise as a 200x400 image with red on top.
+func writeRotatedJPEG(t *testing.T) string {
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(img, image.Rect(0, 0, 200, 200), image.NewUniform(red), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(200, 0, 400, 200), image.NewUniform(blue), image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An APP1 segment with a big-endian TIFF header and a single IFD0 entry
+	// for the orientation, as a SHORT
+	app1 := []byte{
+		0xff, 0xe1, 0x00, 0x22,
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08,
+		0x00, 0x01,
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	data := append(append(buf.Bytes()[:2:2], app1...), buf.Bytes()[2:]...)
+
+	path := filepath.Join(t.TempDir(), "rotated.jpg")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func withAutoOrient(t *testing.T) {
+	old := *autoOrient
+	t.Cleanup(func() { *autoOrient = old })
+	*autoOrient = true
+}
+
+// decodeTestSource decodes the source at path like enqueue does.
+func decodeTestSource(t *testing.T, path string) image.Image {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := decodeSource(f, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// isColor returns whether c is within the JPEG error of want.
+func isColor(c color.Color, want color.NRGBA) bool {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	near := func(a, b uint8) bool {
+		d := int(a) - int(b)
+		return d > -40 && d < 40
+	}
+	return near(n.R, want.R) && near(n.G, want.G) && near(n.B, want.B)
+}
+
+func TestDecodeSourceAppliesEXIFOrientation(t *testing.T) {
+	withAutoOrient(t)
+	path := writeRotatedJPEG(t)
+
+	img := decodeTestSource(t, path)
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 200 || h != 400 {
+		t.Fatalf("decoded image is %dx%d, expected 200x400", w, h)
+	}
+	if c := img.At(100, 50); !isColor(c, red) {
+		t.Errorf("top of decoded image is %v, expected red", c)
+	}
+	if c := img.At(100, 350); !isColor(c, blue) {
+		t.Errorf("bottom of decoded image is %v, expected blue", c)
+	}
+
+	cfg, err := decodeConfig(osFS{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 200 || cfg.Height != 400 {
+		t.Errorf("config is %dx%d, expected the oriented 200x400", cfg.Width, cfg.Height)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Output describes an encoded image that was written to disk.
+type Output struct {
+	Source string
+	Path   string
+	Format string
+	Size   Size
+	Width  int
+	Height int
+	Bytes  int64
+	Hash   string
+
+	Provenance Provenance
+}
+
+// OutputList collects the outputs produced during a run, it is safe for concurrent use.
+type OutputList struct {
+	mu   sync.Mutex
+	list []Output
+}
+
+func (o *OutputList) Add(out Output) {
+	o.mu.Lock()
+	o.list = append(o.list, out)
+	o.mu.Unlock()
+}
+
+// Remove drops the outputs written to path.
+func (o *OutputList) Remove(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	kept := o.list[:0]
+	for _, out := range o.list {
+		if out.Path != path {
+			kept = append(kept, out)
+		}
+	}
+	o.list = kept
+}
+
+// All returns a copy of the collected outputs sorted by path.
+func (o *OutputList) All() []Output {
+	o.mu.Lock()
+	list := make([]Output, len(o.list))
+	copy(list, o.list)
+	o.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+	return list
+}
+
+// writeOutputList writes the paths of outputs to path, one per line.
+func writeOutputList(path string, outputs []Output) error {
+	var b strings.Builder
+	for _, out := range outputs {
+		b.WriteString(out.Path)
+		b.WriteByte('\n')
+	}
+
+	return writeOutputFile(path, []byte(b.String()))
+}
+
+// OutputClaims tracks which source produces each output path, to detect sources
+// that would overwrite each other's outputs. Paths that only differ in case are
+// the same on case-insensitive file systems. It is safe for concurrent use.
+type OutputClaims struct {
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+// Claim records that source produces path. If another source already did, it
+// returns that source and false.
+func (c *OutputClaims) Claim(path, source string) (string, bool) {
+	key := pathKey(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.owners == nil {
+		c.owners = make(map[string]string)
+	}
+
+	if owner, ok := c.owners[key]; ok && owner != source {
+		return owner, false
+	}
+
+	c.owners[key] = source
+	return source, true
+}
+
+// ClaimNew records that source produces path unless any source, source
+// included, already does. It returns whether path was claimed.
+func (c *OutputClaims) ClaimNew(path, source string) bool {
+	key := pathKey(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.owners == nil {
+		c.owners = make(map[string]string)
+	}
+
+	if _, ok := c.owners[key]; ok {
+		return false
+	}
+
+	c.owners[key] = source
+	return true
+}
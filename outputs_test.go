@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// withSourceRoots sets -outDir and -srcRoot as if given on the command line.
+func withSourceRoots(t *testing.T, out string, roots ...string) {
+	oldOut, oldRoot, oldRoots := *outFolder, *srcRoot, srcRoots
+	t.Cleanup(func() { *outFolder, *srcRoot, srcRoots = oldOut, oldRoot, oldRoots })
+
+	*outFolder, srcRoots = out, roots
+	for i, r := range roots {
+		if i > 0 {
+			*srcRoot += ","
+		}
+		*srcRoot += r
+	}
+}
+
+func TestOverlappingBasenamesAcrossRoots(t *testing.T) {
+	dir := t.TempDir()
+	a, b, out := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "out")
+	withSourceRoots(t, out, a, b)
+
+	first, err := outputBase(filepath.Join(a, "gallery", "photo.jpg"), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := outputBase(filepath.Join(b, "gallery", "photo.jpg"), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.Join(out, "gallery", "photo")
+	if first != want || second != want {
+		t.Fatalf("outputs are %s and %s, expected both to be %s", first, second, want)
+	}
+
+	var claims OutputClaims
+	if _, ok := claims.Claim(first, filepath.Join(a, "gallery", "photo.jpg")); !ok {
+		t.Fatal("first claim failed")
+	}
+	owner, ok := claims.Claim(second, filepath.Join(b, "gallery", "photo.jpg"))
+	if ok {
+		t.Fatal("second source claimed the output of the first")
+	}
+	if owner != filepath.Join(a, "gallery", "photo.jpg") {
+		t.Errorf("output is owned by %s, expected the source in the first root", owner)
+	}
+
+	// The same basename in different folders of each root doesn't collide
+	other, err := outputBase(filepath.Join(b, "photo.jpg"), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other != filepath.Join(out, "photo") {
+		t.Errorf("output is %s, expected it at the top of %s", other, out)
+	}
+	if _, ok := claims.Claim(other, filepath.Join(b, "photo.jpg")); !ok {
+		t.Error("distinct output was reported as colliding")
+	}
+}
+
+func TestSourceRelDirPicksInnermostRoot(t *testing.T) {
+	dir := t.TempDir()
+	r := filepath.Join(dir, "r")
+
+	for _, test := range []struct {
+		roots []string
+		file  string
+		want  string
+	}{
+		{[]string{r, filepath.Join(r, "g")}, filepath.Join(r, "g", "f.jpg"), "."},
+		{[]string{filepath.Join(r, "g"), r}, filepath.Join(r, "g", "f.jpg"), "."},
+		{[]string{r, filepath.Join(r, "gg")}, filepath.Join(r, "gg", "f.jpg"), "."},
+		{[]string{r, filepath.Join(r, "g")}, filepath.Join(r, "g", "h", "f.jpg"), "h"},
+		{[]string{r, filepath.Join(r, "g")}, filepath.Join(r, "h", "f.jpg"), "h"},
+		{[]string{r, filepath.Join(r, "g", "h")}, filepath.Join(r, "g", "f.jpg"), "g"},
+	} {
+		withSourceRoots(t, filepath.Join(dir, "out"), test.roots...)
+
+		got, err := sourceRelDir(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s with roots %v is in %s, expected %s", test.file, test.roots, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/sync/semaphore"
+)
+
+// pHashSize is the size images are downsampled to before computing their pHash.
+const pHashSize = 32
+
+// pHash computes a 64 bit perceptual hash of img. It takes the discrete cosine
+// transform of a 32x32 grayscale downsample of it, flattened over white, and
+// sets a bit for each of the lowest 8x8 frequencies that is above their median.
+func pHash(img image.Image) uint64 {
+	bg := imaging.New(pHashSize, pHashSize, color.White)
+	small := imaging.Grayscale(imaging.Overlay(bg, imaging.Resize(img, pHashSize, pHashSize, imaging.Box), image.Point{}, 1))
+
+	var pixels [pHashSize][pHashSize]float64
+	for y := 0; y < pHashSize; y++ {
+		for x := 0; x < pHashSize; x++ {
+			pixels[y][x] = float64(small.Pix[y*small.Stride+x*4])
+		}
+	}
+
+	// Separable DCT-II, only the 8x8 lowest frequencies are needed
+	var rows [pHashSize][8]float64
+	for y := 0; y < pHashSize; y++ {
+		for u := 0; u < 8; u++ {
+			for x := 0; x < pHashSize; x++ {
+				rows[y][u] += pixels[y][x] * math.Cos(float64((2*x+1)*u)*math.Pi/(2*pHashSize))
+			}
+		}
+	}
+
+	var coeffs []float64
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < pHashSize; y++ {
+				sum += rows[y][u] * math.Cos(float64((2*y+1)*v)*math.Pi/(2*pHashSize))
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	// The DC coefficient is the average brightness, leave it out of the median
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, c := range coeffs {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+
+	return hash
+}
+
+// findPerceptualDuplicates hashes every file and maps the ones that are within
+// maxDistance bits of an earlier file to it. Files that can't be decoded are left
+// out, they fail later when being processed.
+func findPerceptualDuplicates(files []string, maxDistance int) map[string]string {
+	hashes := make([]uint64, len(files))
+	ok := make([]bool, len(files))
+
+	var wg sync.WaitGroup
+	sem := semaphore.NewWeighted(int64(*parallel))
+
+	for i, f := range files {
+		wg.Add(1)
+		go func(i int, f string) {
+			defer wg.Done()
+			sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			in, err := srcFS.Open(f)
+			if err != nil {
+				return
+			}
+			defer in.Close()
+
+			img, err := decodeSource(in, f)
+			if err != nil {
+				return
+			}
+
+			hashes[i], ok[i] = pHash(prepareSource(img)), true
+		}(i, f)
+	}
+	wg.Wait()
+
+	dupes := make(map[string]string)
+	var originals []int
+
+	for i, f := range files {
+		if !ok[i] {
+			continue
+		}
+
+		found := false
+		for _, o := range originals {
+			if bits.OnesCount64(hashes[i]^hashes[o]) <= maxDistance {
+				dupes[f] = files[o]
+				found = true
+
+				if !*quiet {
+					logEvent(f, "skip", logFields{"reason": "duplicate", "original": files[o]}, "%s looks like a duplicate of %s, using its outputs", f, files[o])
+				}
+				break
+			}
+		}
+
+		if !found {
+			originals = append(originals, i)
+		}
+	}
+
+	return dupes
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// PipelineStep is a step of the processing pipeline, with params overriding the
+// options it takes its settings from.
+type PipelineStep struct {
+	Name   string             `json:"step"`
+	Params map[string]float64 `json:"params,omitempty"`
+}
+
+// pipelineParams lists the steps a pipeline can have and the params each accepts.
+var pipelineParams = map[string][]string{
+	"lut":       nil,
+	"trim":      {"padding"},
+	"denoise":   {"strength"},
+	"resize":    nil,
+	"sharpen":   {"sigma"},
+	"posterize": {"levels"},
+}
+
+// defaultPipeline is the order images are processed in without -pipeline.
+var defaultPipeline = []PipelineStep{
+	{Name: "lut"},
+	{Name: "trim"},
+	{Name: "denoise"},
+	{Name: "resize"},
+	{Name: "sharpen"},
+	{Name: "posterize"},
+}
+
+// pipeline is the order images are processed in, set with -pipeline.
+var pipeline = defaultPipeline
+
+// loadPipeline reads a pipeline from the JSON file at path, in the form
+// {"steps": [{"step": "resize"}, {"step": "sharpen", "params": {"sigma": 1}}]}.
+// It must resize exactly once, trim before resizing, and may end with an encode step for clarity,
+// since encoding always comes last.
+func loadPipeline(path string) ([]PipelineStep, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	var file struct {
+		Steps []PipelineStep `json:"steps"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse file: %w", err)
+	}
+
+	steps := file.Steps
+	if n := len(steps); n > 0 && steps[n-1].Name == "encode" && len(steps[n-1].Params) == 0 {
+		steps = steps[:n-1]
+	}
+
+	resizes := 0
+	for _, s := range steps {
+		params, ok := pipelineParams[s.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown step %q, expected one of %s, or encode as the last step", s.Name, strings.Join(pipelineStepNames(), ", "))
+		}
+		if s.Name == "resize" {
+			resizes++
+		}
+		// Outputs must keep the dimensions they were resized to, which are the
+		// ones listed in manifests and srcsets
+		if s.Name == "trim" && resizes > 0 {
+			return nil, fmt.Errorf("step trim changes dimensions, it must come before resize")
+		}
+
+		for name, v := range s.Params {
+			if !containsString(params, name) {
+				return nil, fmt.Errorf("unknown param %s of step %s", name, s.Name)
+			}
+			if v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+				return nil, fmt.Errorf("invalid %s %g of step %s, can't be negative", name, v, s.Name)
+			}
+		}
+
+		if levels, ok := s.Params["levels"]; ok {
+			if err := checkPosterize(int(levels)); err != nil || levels != math.Trunc(levels) {
+				return nil, fmt.Errorf("invalid levels %g of step %s, must be a whole number between 2 and 256", levels, s.Name)
+			}
+		}
+	}
+	if resizes != 1 {
+		return nil, fmt.Errorf("the pipeline must resize exactly once, it resizes %d times", resizes)
+	}
+
+	return steps, nil
+}
+
+func pipelineStepNames() []string {
+	names := make([]string, 0, len(pipelineParams))
+	for name := range pipelineParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceSteps returns the steps before resizing, which run once per source
+// since their result is shared by all sizes.
+func sourceSteps() []PipelineStep {
+	for i, s := range pipeline {
+		if s.Name == "resize" {
+			return pipeline[:i]
+		}
+	}
+	return pipeline
+}
+
+// outputSteps returns the steps after resizing, which run for every output.
+func outputSteps() []PipelineStep {
+	for i, s := range pipeline {
+		if s.Name == "resize" {
+			return pipeline[i+1:]
+		}
+	}
+	return nil
+}
+
+// setting returns the amount step s applies to an output of size, or to the
+// source if size is nil, which is its param if set or otherwise the option it
+// takes it from. Steps whose setting is 0 leave images as they are.
+func (s PipelineStep) setting(size *Size) float64 {
+	param := func(name string, option float64) float64 {
+		if v, ok := s.Params[name]; ok {
+			return v
+		}
+		return option
+	}
+
+	switch s.Name {
+	case "lut":
+		if colorLUT != nil {
+			return 1
+		}
+	case "trim":
+		// Trimming is turned on by a padding param even if it's 0
+		if _, ok := s.Params["padding"]; ok || *trimTransparent {
+			return 1
+		}
+	case "denoise":
+		return param("strength", *denoiseStrength)
+	case "sharpen":
+		sigma := *sharpen
+		if size != nil {
+			sigma = size.sharpen()
+		}
+		return param("sigma", sigma)
+	case "posterize":
+		levels := *posterizeLevels
+		if size != nil {
+			levels = size.posterize()
+		}
+		return param("levels", float64(levels))
+	}
+	return 0
+}
+
+// apply runs step s on img, which is an output of size or the source if size is nil.
+func (s PipelineStep) apply(img image.Image, size *Size) image.Image {
+	if s.setting(size) <= 0 {
+		return img
+	}
+
+	switch s.Name {
+	case "lut":
+		return colorLUT.Apply(img)
+	case "trim":
+		padding := *trimPadding
+		if v, ok := s.Params["padding"]; ok {
+			padding = int(v)
+		}
+		return trimTransparentPadding(img, padding)
+	case "denoise":
+		return denoise(img, *denoiseFilter, s.setting(size))
+	case "sharpen":
+		return imaging.Sharpen(img, s.setting(size))
+	case "posterize":
+		return posterize(img, int(s.setting(size)))
+	}
+	return img
+}
+
+// finishOutput runs the steps after resizing on img, an output of size.
+func finishOutput(img image.Image, size Size) image.Image {
+	for _, s := range outputSteps() {
+		img = s.apply(img, &size)
+	}
+	return img
+}
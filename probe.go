@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"text/tabwriter"
+	"unicode/utf16"
+)
+
+// ProbeInfo describes a source image as printed by -probe.
+type ProbeInfo struct {
+	Path        string `json:"path"`
+	Format      string `json:"format,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	ColorModel  string `json:"colorModel,omitempty"`
+	Alpha       bool   `json:"alpha"`
+	Orientation int    `json:"orientation,omitempty"`
+	Profile     string `json:"profile,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// probeImages prints information about every file without processing it, as a
+// table or as a JSON array depending on format.
+func probeImages(files []string, format string) error {
+	infos := make([]ProbeInfo, len(files))
+	for i, f := range files {
+		infos[i] = probeImage(f)
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tFORMAT\tSIZE\tCOLOR\tALPHA\tORIENTATION\tPROFILE")
+	for _, info := range infos {
+		if info.Error != "" {
+			fmt.Fprintf(w, "%s\terror: %s\n", info.Path, info.Error)
+			continue
+		}
+
+		profile := info.Profile
+		if profile == "" {
+			profile = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%dx%d\t%s\t%t\t%d\t%s\n", info.Path, info.Format, info.Width, info.Height, info.ColorModel, info.Alpha, info.Orientation, profile)
+	}
+	return w.Flush()
+}
+
+func probeImage(path string) ProbeInfo {
+	info := ProbeInfo{Path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	info.Format = format
+	info.Width, info.Height = cfg.Width, cfg.Height
+	info.ColorModel, info.Alpha = describeColorModel(cfg.ColorModel)
+	info.Orientation = exifOrientation(bytes.NewReader(data))
+
+	if profile, err := readICCProfile(data); err == nil && profile != nil {
+		info.Profile = profileDescription(profile)
+	}
+
+	return info
+}
+
+// describeColorModel returns the name of m and whether it can hold transparency.
+func describeColorModel(m color.Model) (string, bool) {
+	switch m {
+	case color.RGBAModel:
+		return "rgba", true
+	case color.RGBA64Model:
+		return "rgba64", true
+	case color.NRGBAModel:
+		return "nrgba", true
+	case color.NRGBA64Model:
+		return "nrgba64", true
+	case color.AlphaModel:
+		return "alpha", true
+	case color.Alpha16Model:
+		return "alpha16", true
+	case color.GrayModel:
+		return "gray", false
+	case color.Gray16Model:
+		return "gray16", false
+	case color.YCbCrModel:
+		return "ycbcr", false
+	case color.NYCbCrAModel:
+		return "nycbcra", true
+	case color.CMYKModel:
+		return "cmyk", false
+	}
+
+	if p, ok := m.(color.Palette); ok {
+		alpha := false
+		for _, c := range p {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				alpha = true
+			}
+		}
+		return fmt.Sprintf("palette(%d)", len(p)), alpha
+	}
+
+	return "unknown", true
+}
+
+// profileDescription returns the description of an ICC profile, or "embedded"
+// if it has none that can be read.
+func profileDescription(profile []byte) string {
+	if len(profile) < 132 {
+		return "embedded"
+	}
+
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count && 132+i*12+12 <= len(profile); i++ {
+		entry := profile[132+i*12:]
+		if string(entry[:4]) != "desc" {
+			continue
+		}
+
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+		if offset+size > len(profile) || size < 12 {
+			break
+		}
+
+		if desc := parseTextDescription(profile[offset : offset+size]); desc != "" {
+			return desc
+		}
+		break
+	}
+
+	return "embedded"
+}
+
+// parseTextDescription reads an ICC v2 textDescriptionType or the first record
+// of a v4 multiLocalizedUnicodeType.
+func parseTextDescription(tag []byte) string {
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+n > len(tag) {
+			return ""
+		}
+		return string(bytes.TrimRight(tag[12:12+n], "\x00"))
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+length > len(tag) {
+			return ""
+		}
+
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+i*2:])
+		}
+		return string(utf16.Decode(units))
+	}
+
+	return ""
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ProgressStream writes events as they happen for another process to follow
+// the run, one self-contained JSON object per line. Unlike the log it ignores
+// -quiet and -orderedOutput. It is safe for concurrent use.
+type ProgressStream struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// progress is set with -progressJson.
+var progress *ProgressStream
+
+// openProgressStream opens target for writing events to, which is stdout for
+// "-", an already open file descriptor for a number like 3 and a file to create
+// otherwise.
+func openProgressStream(target string) (*ProgressStream, error) {
+	if target == "-" {
+		return &ProgressStream{w: os.Stdout}, nil
+	}
+
+	if fd, err := strconv.Atoi(target); err == nil {
+		if fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		return &ProgressStream{w: os.NewFile(uintptr(fd), "progress")}, nil
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+	return &ProgressStream{w: f}, nil
+}
+
+// reportProgress writes an event about the image at path, or about the run if
+// path is empty, if -progressJson is set.
+func reportProgress(path, event string, fields logFields) {
+	if progress == nil {
+		return
+	}
+
+	all := logFields{"event": event, "time": time.Now().Format(time.RFC3339Nano)}
+	if path != "" {
+		all["source"] = path
+	}
+	for k, v := range fields {
+		all[k] = v
+	}
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.w.Write(append(data, '\n'))
+}
+
+func (p *ProgressStream) Close() error {
+	if p.w == os.Stdout {
+		return nil
+	}
+	return p.w.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// version is the version of the tool reported in provenance, it can be set
+// when building with -ldflags "-X main.version=v1.2.3". Otherwise the module
+// version recorded by go install is used.
+var version = ""
+
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// Provenance describes how an output was produced, listed in the manifest with
+// -resizeAlgorithmInfo and available to -comment as {provenance}.
+type Provenance struct {
+	// Resampling filter used to resize the source, "vector" for SVG sources
+	// rasterized at the size of the output and empty if it wasn't resized
+	Filter   string  `json:"filter,omitempty"`
+	Quality  float64 `json:"quality,omitempty"`
+	Lossless bool    `json:"lossless,omitempty"`
+	Version  string  `json:"version"`
+}
+
+func provenanceFor(size Size, filter string, quality float64) Provenance {
+	p := Provenance{Filter: filter, Version: toolVersion()}
+	if isLossy(size) {
+		p.Quality = quality
+	} else {
+		p.Lossless = true
+	}
+	return p
+}
+
+func (p Provenance) String() string {
+	parts := []string{"go-websizer " + p.Version}
+	if p.Filter != "" {
+		parts = append(parts, "filter "+p.Filter)
+	}
+	if p.Lossless {
+		parts = append(parts, "lossless")
+	} else if p.Quality > 0 {
+		parts = append(parts, fmt.Sprintf("quality %g", p.Quality))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// commentFor returns -comment for an output produced as p describes.
+func commentFor(p Provenance) string {
+	return strings.ReplaceAll(*comment, "{provenance}", p.String())
+}
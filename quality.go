@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// isLossy returns whether the quality setting has any effect when encoding to size.
+func isLossy(size Size) bool {
+	switch size.Format {
+	case "webp":
+		return !size.lossless()
+	case "jpeg", "jpg":
+		return true
+	}
+
+	return false
+}
+
+// searchQuality finds the highest quality for which the encoded size of img
+// satisfies fits, using a binary search. If no quality fits the lowest one is
+// returned.
+func searchQuality(img image.Image, size Size, fits func(n int64) bool) (float64, error) {
+	return bisectQuality(func(q float64) (bool, error) {
+		cw := &countingWriter{w: io.Discard}
+		if err := encode(cw, img, size, q); err != nil {
+			return false, err
+		}
+
+		return fits(cw.n), nil
+	})
+}
+
+// bisectQuality returns the highest quality between -minQuality and -maxQuality
+// for which ok returns true, assuming that it does for every quality below it.
+// If none does the lowest one is returned.
+func bisectQuality(ok func(q float64) (bool, error)) (float64, error) {
+	lo, hi := *minQuality, *maxQuality
+	best := lo
+
+	for lo <= hi {
+		mid := (lo + hi) / 2
+
+		fits, err := ok(float64(mid))
+		if err != nil {
+			return 0, err
+		}
+
+		if fits {
+			best = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	return float64(best), nil
+}
+
+// qualityForBpp returns the highest quality that encodes img within the given
+// number of bits per pixel.
+func qualityForBpp(img image.Image, size Size, bpp float64) (float64, error) {
+	pixels := float64(img.Bounds().Dx() * img.Bounds().Dy())
+
+	return searchQuality(img, size, func(n int64) bool {
+		return float64(n*8)/pixels <= bpp
+	})
+}
+
+// encodedSSIM returns the SSIM of img encoded to size at quality against img.
+func encodedSSIM(img image.Image, size Size, quality float64) (float64, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, img, size, quality); err != nil {
+		return 0, err
+	}
+
+	decoded, _, err := image.Decode(&buf)
+	if err != nil {
+		return 0, fmt.Errorf("decode encoded image: %w", err)
+	}
+
+	return ssim(img, decoded), nil
+}
+
+// qualityForSSIM returns the lowest quality at which img encoded to size has
+// at least the given SSIM against img.
+func qualityForSSIM(img image.Image, size Size, target float64) (float64, error) {
+	// bisectQuality looks for the highest quality that passes, so search over
+	// the qualities that fall short of the target and step above the last one
+	below, err := bisectQuality(func(q float64) (bool, error) {
+		s, err := encodedSSIM(img, size, q)
+		return s < target, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if below == float64(*minQuality) {
+		if s, err := encodedSSIM(img, size, below); err != nil || s >= target {
+			return below, err
+		}
+	}
+
+	return math.Min(below+1, float64(*maxQuality)), nil
+}
+
+// linkQualityReferences makes the largest job of every lossy format the quality
+// reference for the rest of the jobs of that format. Jobs are ordered from largest
+// to smallest so that references are processed first.
+func linkQualityReferences(jobs []*Job) {
+	sortLargestFirst(jobs)
+
+	refs := make(map[string]*Job)
+	for _, job := range jobs {
+		if !isLossy(job.size) {
+			continue
+		}
+
+		ref, ok := refs[job.size.Format]
+		if !ok {
+			job.measured = make(chan struct{})
+			refs[job.size.Format] = job
+			continue
+		}
+
+		job.qualityRef = ref
+	}
+}
+
+// complexitySampleSize is the size images are downsampled to before measuring their complexity.
+const complexitySampleSize = 256
+
+// edgeThreshold is the Sobel gradient magnitude from which a pixel counts as an edge.
+const edgeThreshold = 96
+
+// referenceEdgeDensity is the edge density of an image of average complexity,
+// which is encoded at the configured quality when using -adaptiveQuality.
+const referenceEdgeDensity = 0.1
+
+// edgeDensity estimates the complexity of img as the fraction of its pixels
+// that lie on an edge according to a Sobel operator.
+func edgeDensity(img image.Image) float64 {
+	gray := imaging.Grayscale(imaging.Fit(img, complexitySampleSize, complexitySampleSize, imaging.Box))
+	w, h := gray.Bounds().Dx(), gray.Bounds().Dy()
+	if w < 3 || h < 3 {
+		return referenceEdgeDensity
+	}
+
+	at := func(x, y int) float64 {
+		return float64(gray.Pix[y*gray.Stride+x*4])
+	}
+
+	edges := 0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+
+			if math.Hypot(gx, gy) >= edgeThreshold {
+				edges++
+			}
+		}
+	}
+
+	return float64(edges) / float64((w-2)*(h-2))
+}
+
+// adaptQuality moves quality up to band points up for images more complex than
+// average and down for flatter ones, within -minQuality and -maxQuality.
+func adaptQuality(quality, density, band float64) float64 {
+	// Maps the reference density to 0, no edges to -1 and twice the reference or more to 1
+	offset := math.Max(-1, math.Min(1, density/referenceEdgeDensity-1))
+
+	return math.Max(float64(*minQuality), math.Min(float64(*maxQuality), math.Round(quality+offset*band)))
+}
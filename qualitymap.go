@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// QualityMap overrides the quality of the images listed in a CSV file of
+// path,quality rows, where path may also be a glob.
+type QualityMap struct {
+	exact map[string]float64
+	globs []qualityGlob
+}
+
+type qualityGlob struct {
+	pattern string
+	quality float64
+}
+
+// loadQualityMap reads a quality map from the CSV file at path. A first row
+// whose quality isn't a number is taken as a header and skipped.
+func loadQualityMap(path string) (*QualityMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+
+	m := &QualityMap{exact: make(map[string]float64)}
+
+	for row := 1; ; row++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+
+		q, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err != nil && row == 1 {
+			continue
+		}
+		if err != nil || q < 0 || q > 100 {
+			return nil, fmt.Errorf("invalid quality %s for %s, must be within 0-100", rec[1], rec[0])
+		}
+
+		if strings.ContainsAny(rec[0], "*?[") {
+			m.globs = append(m.globs, qualityGlob{rec[0], q})
+		} else {
+			m.exact[filepath.Clean(rec[0])] = q
+		}
+	}
+
+	return m, nil
+}
+
+// Quality returns the quality for the image at path. Exact paths take precedence
+// over globs, which are tried in the order they are listed.
+func (m *QualityMap) Quality(path string) (float64, bool) {
+	if q, ok := m.exact[filepath.Clean(path)]; ok {
+		return q, true
+	}
+
+	for _, g := range m.globs {
+		if matchGlob(g.pattern, path) {
+			return g.quality, true
+		}
+	}
+
+	return 0, false
+}
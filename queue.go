@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/heap"
+	"strings"
+	"sync"
+)
+
+// JobQueue feeds jobs to the workers, the ones of images matching -priority
+// first and the rest in the order they were pushed. Like a buffered channel, it
+// holds a limited number of jobs and Push blocks while it's full. It is safe for
+// concurrent use.
+type JobQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	items    jobHeap
+	seq      int
+	capacity int
+	closed   bool
+}
+
+func newJobQueue(capacity int) *JobQueue {
+	q := &JobQueue{capacity: capacity}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds job to the queue, ahead of the jobs without priority if priority
+// is set.
+func (q *JobQueue) Push(job *Job, priority bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) >= q.capacity {
+		q.notFull.Wait()
+	}
+
+	heap.Push(&q.items, queuedJob{job: job, priority: priority, seq: q.seq})
+	q.seq++
+	q.notEmpty.Signal()
+}
+
+// Pop removes and returns the next job, blocking until there is one. ok is
+// false once the queue is closed and empty.
+func (q *JobQueue) Pop() (job *Job, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.notEmpty.Wait()
+	}
+
+	next := heap.Pop(&q.items).(queuedJob)
+	q.notFull.Signal()
+	return next.job, true
+}
+
+// Close makes Pop return once the queue is empty, no more jobs can be pushed.
+func (q *JobQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+}
+
+type queuedJob struct {
+	job      *Job
+	priority bool
+	seq      int
+}
+
+type jobHeap []queuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(queuedJob)) }
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// hasPriority returns whether path matches one of the comma-separated globs of
+// -priority.
+func hasPriority(path string) bool {
+	if *priorityGlobs == "" {
+		return false
+	}
+
+	for _, pattern := range strings.Split(*priorityGlobs, ",") {
+		if matchGlob(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// prioritized returns files with the ones matching -priority first, keeping
+// the order of files otherwise.
+func prioritized(files []string) []string {
+	sorted := make([]string, 0, len(files))
+	for _, f := range files {
+		if hasPriority(f) {
+			sorted = append(sorted, f)
+		}
+	}
+	for _, f := range files {
+		if !hasPriority(f) {
+			sorted = append(sorted, f)
+		}
+	}
+	return sorted
+}
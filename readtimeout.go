@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// timeoutFS is a file system whose files fail to open or read once timeout has
+// passed since they started opening, so that a hanging network mount fails the
+// image instead of stalling a worker forever. Calls that hang are left running
+// in the background, since blocked file system calls can't be interrupted.
+type timeoutFS struct {
+	fs      fs.FS
+	timeout time.Duration
+}
+
+type openResult struct {
+	f   fs.File
+	err error
+}
+
+func (t timeoutFS) Open(path string) (fs.File, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+
+	done := make(chan openResult, 1)
+	go func() {
+		f, err := t.fs.Open(path)
+		done <- openResult{f, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			cancel()
+			return nil, res.err
+		}
+		return &timeoutFile{File: res.f, ctx: ctx, cancel: cancel, timeout: t.timeout}, nil
+
+	case <-ctx.Done():
+		cancel()
+
+		// Don't leak the file if it opens eventually
+		go func() {
+			if res := <-done; res.err == nil {
+				res.f.Close()
+			}
+		}()
+		return nil, fmt.Errorf("open %s: timed out after %s", path, t.timeout)
+	}
+}
+
+// timeoutFile is a file whose reads fail once its context is done.
+type timeoutFile struct {
+	fs.File
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (f *timeoutFile) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("read timed out after %s", f.timeout)
+	}
+
+	// Read into a buffer of our own, the caller may reuse p once we return even
+	// if the read is still hanging
+	buf := make([]byte, len(p))
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := f.File.Read(buf)
+		done <- readResult{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		return copy(p, buf[:res.n]), res.err
+	case <-f.ctx.Done():
+		return 0, fmt.Errorf("read timed out after %s", f.timeout)
+	}
+}
+
+func (f *timeoutFile) Close() error {
+	f.cancel()
+	return f.File.Close()
+}
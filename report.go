@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JobReport writes per-job timings to a CSV file, it is safe for concurrent use.
+type JobReport struct {
+	mu  sync.Mutex
+	f   *os.File
+	csv *csv.Writer
+}
+
+type JobTimings struct {
+	Decode, Resize, Encode time.Duration
+	Bytes                  int64
+}
+
+func newJobReport(path string) (*JobReport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+
+	r := &JobReport{f: f, csv: csv.NewWriter(f)}
+	r.csv.Write([]string{"source", "size", "format", "decode_ms", "resize_ms", "encode_ms", "output_bytes"})
+
+	return r, nil
+}
+
+func (r *JobReport) Add(job *Job, t JobTimings) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.csv.Write([]string{
+		job.origPath,
+		job.size.String(),
+		job.size.Format,
+		formatMillis(t.Decode),
+		formatMillis(t.Resize),
+		formatMillis(t.Encode),
+		strconv.FormatInt(t.Bytes, 10),
+	})
+}
+
+// reportJob adds a row for job to the job report if there is one, in input
+// order with -orderedOutput.
+func reportJob(job *Job, t JobTimings) {
+	if jobReport == nil {
+		return
+	}
+
+	inOrder(job.origPath, func() { jobReport.Add(job, t) })
+}
+
+func (r *JobReport) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.csv.Flush()
+	if err := r.csv.Error(); err != nil {
+		r.f.Close()
+		return err
+	}
+
+	return r.f.Close()
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 2, 64)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
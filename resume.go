@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// ResumeIndex decides which sources can be skipped because a previous manifest
+// already lists all of their variants, it is safe for concurrent use.
+type ResumeIndex struct {
+	sources map[string]*ManifestSource
+
+	mu      sync.Mutex
+	skipped []*ManifestSource
+}
+
+func loadResumeIndex(path string) (*ResumeIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+
+	r := &ResumeIndex{sources: make(map[string]*ManifestSource, len(m.Sources))}
+	for _, src := range m.Sources {
+		r.sources[src.Path] = src
+	}
+
+	return r, nil
+}
+
+// Skip returns whether the source at path is unchanged since the manifest was
+// written and all of its planned variants are listed in it.
+func (r *ResumeIndex) Skip(fsys fs.FS, path string, planned []plannedVariant) bool {
+	src, ok := r.sources[path]
+	if !ok {
+		return false
+	}
+
+	listed := make(map[string]bool, len(src.Variants))
+	for _, v := range src.Variants {
+		listed[v.Path] = true
+	}
+	for _, v := range planned {
+		if !listed[v.path] {
+			return false
+		}
+	}
+
+	fi, err := fs.Stat(fsys, path)
+	if err != nil {
+		return false
+	}
+
+	// The modification time may change without the contents changing, e.g. after a
+	// fresh checkout, so fall back to comparing hashes
+	if !fi.ModTime().Equal(src.ModTime) {
+		if src.Hash == "" {
+			return false
+		}
+
+		hash, err := sourceHash(fsys, path)
+		if err != nil || hash != src.Hash {
+			return false
+		}
+	}
+
+	r.mu.Lock()
+	r.skipped = append(r.skipped, src)
+	r.mu.Unlock()
+
+	return true
+}
+
+// Skipped returns the manifest entries of the sources that were skipped.
+func (r *ResumeIndex) Skipped() []*ManifestSource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.skipped
+}
+
+func sourceHash(fsys fs.FS, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// jsonSchemaURI is the JSON Schema draft the manifest schema follows.
+const jsonSchemaURI = "https://json-schema.org/draft/2020-12/schema"
+
+// printManifestSchema writes the JSON Schema of the manifest to stdout. The
+// schema is derived from the Manifest type, so it can't go out of date.
+func printManifestSchema() error {
+	defs := make(map[string]interface{})
+
+	schema := schemaFor(reflect.TypeOf(Manifest{}), defs).(map[string]interface{})
+	schema["$schema"] = jsonSchemaURI
+	schema["title"] = "go-websizer manifest"
+	schema["$defs"] = defs
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schema)
+}
+
+// schemaFor returns the schema of the JSON encoding of values of type t. Named
+// struct types other than the root one are added to defs and referenced.
+func schemaFor(t reflect.Type, defs map[string]interface{}) interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), defs)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), defs)}
+	case reflect.Struct:
+		if t != reflect.TypeOf(Manifest{}) {
+			if _, ok := defs[t.Name()]; !ok {
+				// Reserve the name first in case the type refers to itself
+				defs[t.Name()] = nil
+				defs[t.Name()] = structSchema(t, defs)
+			}
+			return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+		}
+		return structSchema(t, defs)
+	}
+
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	props := make(map[string]interface{})
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name, opts := f.Name, ""
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if comma := strings.IndexRune(tag, ','); comma != -1 {
+				name, opts = tag[:comma], tag[comma:]
+			} else {
+				name = tag
+			}
+			if name == "" {
+				name = f.Name
+			}
+		}
+
+		props[name] = schemaFor(f.Type, defs)
+		if !strings.Contains(opts, ",omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
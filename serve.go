@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageServer resizes images under root on demand, picking the format of each
+// response from the Accept header of the request. Outputs are written where a
+// regular run would write them, and served from there while they're up to date.
+type imageServer struct {
+	root string
+
+	mu    sync.Mutex
+	locks map[string]*outputLock
+
+	// Set with -maxDecodedCacheMB
+	cache *DecodedCache
+}
+
+// serveImages serves the images under the first source root, or the current
+// folder if there isn't one, on addr.
+func serveImages(addr string) error {
+	srv := &imageServer{
+		root:  srcRoots[0],
+		locks: make(map[string]*outputLock),
+	}
+	if *decodedCacheMB > 0 {
+		srv.cache = newDecodedCache(*decodedCacheMB << 20)
+	}
+
+	log.Printf("serving images in %s on %s", srv.root, addr)
+	return http.ListenAndServe(addr, srv)
+}
+
+// ServeHTTP serves the image at the request path resized to the size named by
+// the size query parameter, which must be one of the sizes set with -size.
+func (s *imageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Cleaning a rooted path drops any .. elements, so the file is always inside root
+	src := filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := r.URL.Query().Get("size")
+	var candidates []Size
+	for _, size := range sizes {
+		if size.Name() == name {
+			candidates = append(candidates, size)
+		}
+	}
+	if len(candidates) == 0 {
+		http.Error(w, "unknown size", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+
+	size, ok := negotiateFormat(r.Header.Get("Accept"), candidates)
+	if !ok {
+		http.Error(w, "no acceptable format", http.StatusNotAcceptable)
+		return
+	}
+
+	outPath, err := variantPath(src, size)
+	if err == nil {
+		err = s.generate(src, size, outPath)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to resize image %s: %s", src, err)
+		http.Error(w, "failed to resize image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeType(size.Format))
+	http.ServeFile(w, r, outPath)
+}
+
+// outputLock is held while an output is written, waiters counts the requests
+// holding or waiting for it so that it's dropped once none are left.
+type outputLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks the output at outPath and returns a function that unlocks it.
+func (s *imageServer) lock(outPath string) func() {
+	s.mu.Lock()
+	lock, ok := s.locks[outPath]
+	if !ok {
+		lock = &outputLock{}
+		s.locks[outPath] = lock
+	}
+	lock.waiters++
+	s.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		s.mu.Lock()
+		if lock.waiters--; lock.waiters == 0 {
+			delete(s.locks, outPath)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// generate writes the output of src with size to outPath unless it's up to date.
+// Concurrent requests for the same output wait for the first one to write it.
+func (s *imageServer) generate(src string, size Size, outPath string) error {
+	defer s.lock(outPath)()
+
+	if isUpToDate(osFS{}, src, outPath) {
+		return nil
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	var source *decodedSource
+	if s.cache != nil {
+		source, _ = s.cache.Get(src, fi)
+	}
+	if source == nil {
+		if source, err = decodePrepared(src); err != nil {
+			return err
+		}
+		if s.cache != nil {
+			s.cache.Add(src, fi, source)
+		}
+	}
+
+	job := &Job{
+		img:        source.img,
+		size:       size,
+		outPath:    outPath,
+		origPath:   src,
+		decodeTime: source.decodeTime,
+		svg:        source.svg,
+	}
+	if *adaptiveQuality {
+		job.complexity = edgeDensity(source.img)
+	}
+
+	// Outputs are only listed for the manifests written at the end of a run,
+	// which never comes when serving
+	defer func() { outputs.Remove(job.outPath) }()
+
+	return doJob(job)
+}
+
+// decodePrepared decodes the image at src and prepares it for resizing.
+func decodePrepared(src string) (*decodedSource, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer in.Close()
+
+	decodeStart := time.Now()
+	img, err := decodeSource(in, src)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	decodeTime := time.Since(decodeStart)
+
+	var svg *svgSource
+	if !transformsSource() {
+		if svg, err = loadSVG(osFS{}, src); err != nil {
+			return nil, err
+		}
+	}
+
+	return &decodedSource{img: prepareSource(img), svg: svg, decodeTime: decodeTime}, nil
+}
+
+// negotiateFormat picks the candidate whose format comes first in -negotiationOrder
+// among the ones listed in accept. If none is listed but accept has a wildcard or
+// is empty, a jpeg or png candidate is preferred as every client supports them.
+func negotiateFormat(accept string, candidates []Size) (Size, bool) {
+	sorted := make([]Size, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return formatRank(sorted[i].Format) < formatRank(sorted[j].Format)
+	})
+
+	types := make(map[string]bool)
+	wildcard := strings.TrimSpace(accept) == ""
+
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		// A quality of 0 means the type is not acceptable
+		refused := false
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				refused = err == nil && q == 0
+			}
+		}
+		if refused {
+			continue
+		}
+
+		if mediaType == "*/*" || mediaType == "image/*" {
+			wildcard = true
+		}
+		types[mediaType] = true
+	}
+
+	for _, size := range sorted {
+		if types[mimeType(size.Format)] {
+			return size, true
+		}
+	}
+
+	if !wildcard {
+		return Size{}, false
+	}
+
+	for _, size := range sorted {
+		if f := normalizeFormat(size.Format); f == "jpeg" || f == "png" {
+			return size, true
+		}
+	}
+	return sorted[0], true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// shardOutputs splits outputs into n groups of roughly equal total size, by
+// greedily adding the largest remaining output to the smallest group.
+func shardOutputs(outputs []Output, n int) [][]Output {
+	sorted := make([]Output, len(outputs))
+	copy(sorted, outputs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Bytes > sorted[j].Bytes
+	})
+
+	shards := make([][]Output, n)
+	totals := make([]int64, n)
+
+	for _, o := range sorted {
+		min := 0
+		for i := 1; i < n; i++ {
+			if totals[i] < totals[min] {
+				min = i
+			}
+		}
+
+		shards[min] = append(shards[min], o)
+		totals[min] += o.Bytes
+	}
+
+	return shards
+}
+
+// shardPath returns the path of the i-th shard of the manifest at path, e.g.
+// manifest.shard-1.json.
+func shardPath(path string, i int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.shard-%d%s", strings.TrimSuffix(path, ext), i+1, ext)
+}
+
+// writeManifestShards writes n manifests next to path, each listing a subset of
+// outputs of roughly the same total size.
+func writeManifestShards(path string, n int, infos *SourceInfos, outputs []Output) error {
+	for i, shard := range shardOutputs(outputs, n) {
+		if err := writeManifest(shardPath(path, i), buildManifest(infos, shard, nil, nil)); err != nil {
+			return fmt.Errorf("write shard %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+// findCandidateJob returns the job in jobs with the same dimensions and options
+// as size, which the format of size can be added to as a candidate.
+func findCandidateJob(jobs []*Job, size Size) *Job {
+	for _, job := range jobs {
+		if job.size.withoutFormat() == size.withoutFormat() {
+			return job
+		}
+	}
+	return nil
+}
+
+// encodeSmallest encodes img to every candidate format of job and returns the
+// smallest result, updating the size and output path of job to its format.
+func encodeSmallest(job *Job, img image.Image, quality float64) ([]byte, error) {
+	var best []byte
+	filter := job.provenance.Filter
+
+	for _, c := range job.candidates {
+		p := provenanceFor(c.size, filter, quality)
+
+		var buf bytes.Buffer
+		if err := encodeWithRetries(&buf, img, c.size, quality); err != nil {
+			return nil, fmt.Errorf("encode to %s: %w", c.size.Format, err)
+		}
+
+		data, err := addMetadata(buf.Bytes(), img, c.size.Format, commentFor(p))
+		if err != nil {
+			return nil, fmt.Errorf("add metadata: %w", err)
+		}
+
+		if best == nil || len(data) < len(best) {
+			best = data
+			job.size, job.outPath, job.provenance = c.size, c.path, p
+		}
+	}
+
+	return best, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// smartCropSteps is how many strips -smartCrop trims the excess of an image in.
+const smartCropSteps = 10
+
+// smartCrop crops img to w by h keeping its most detailed part, which is
+// usually the subject. Like the entropy strategy of libvips, it repeatedly trims
+// a strip off whichever end of the image has the lowest entropy, so flat
+// backgrounds and sky go before busier areas.
+func smartCrop(img image.Image, w, h int) image.Image {
+	src := imaging.Clone(img)
+	r := src.Bounds()
+
+	if excess := r.Dx() - w; excess > 0 {
+		step := maxInt(1, (excess+smartCropSteps-1)/smartCropSteps)
+		for r.Dx() > w {
+			n := minInt(step, r.Dx()-w)
+
+			left := image.Rect(r.Min.X, r.Min.Y, r.Min.X+n, r.Max.Y)
+			right := image.Rect(r.Max.X-n, r.Min.Y, r.Max.X, r.Max.Y)
+			if entropy(src, left) < entropy(src, right) {
+				r.Min.X += n
+			} else {
+				r.Max.X -= n
+			}
+		}
+	}
+
+	if excess := r.Dy() - h; excess > 0 {
+		step := maxInt(1, (excess+smartCropSteps-1)/smartCropSteps)
+		for r.Dy() > h {
+			n := minInt(step, r.Dy()-h)
+
+			top := image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+n)
+			bottom := image.Rect(r.Min.X, r.Max.Y-n, r.Max.X, r.Max.Y)
+			if entropy(src, top) < entropy(src, bottom) {
+				r.Min.Y += n
+			} else {
+				r.Max.Y -= n
+			}
+		}
+	}
+
+	return imaging.Crop(src, r)
+}
+
+// entropy returns the Shannon entropy in bits of the luma histogram of the
+// pixels of img within r.
+func entropy(img *image.NRGBA, r image.Rectangle) float64 {
+	var hist [256]int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			hist[int(0.299*float64(p[0])+0.587*float64(p[1])+0.114*float64(p[2]))]++
+		}
+	}
+
+	total := float64(r.Dx() * r.Dy())
+	var e float64
+	for _, n := range hist {
+		if n > 0 {
+			p := float64(n) / total
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
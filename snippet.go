@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	snippetHTML = "html"
+	snippetJSX  = "jsx"
+)
+
+// snippetTemplates are the built-in templates of -componentSnippet by flavor.
+var snippetTemplates = map[string]string{
+	snippetHTML: `<picture>
+{{- range .Sources}}
+  <source type="{{.Type}}" srcset="{{attr .Srcset}}">
+{{- end}}
+  <img src="{{attr .Src}}" srcset="{{attr .Srcset}}" width="{{.Width}}" height="{{.Height}}" alt="" loading="lazy" decoding="async"
+{{- if eq .Placeholder "lqip"}} style="background-size: cover; background-image: url({{attr .LQIP}})"{{end}}
+{{- if eq .Placeholder "color"}} style="background-color: {{attr .Color}}"{{end}}
+{{- if eq .Placeholder "blurhash"}} data-blurhash="{{attr .BlurHash}}"{{end}}>
+</picture>
+`,
+	snippetJSX: `<picture>
+{{- range .Sources}}
+  <source type="{{.Type}}" srcSet={{js .Srcset}} />
+{{- end}}
+  <img src={{js .Src}} srcSet={{js .Srcset}} width="{{.Width}}" height="{{.Height}}" alt="" loading="lazy" decoding="async"
+{{- if eq .Placeholder "lqip"}} style={ { backgroundSize: "cover", backgroundImage: {{js (printf "url(%s)" .LQIP)}} } }{{end}}
+{{- if eq .Placeholder "color"}} style={ { backgroundColor: {{js .Color}} } }{{end}}
+{{- if eq .Placeholder "blurhash"}} data-blurhash={{js .BlurHash}}{{end}} />
+</picture>
+`,
+}
+
+var snippetFuncs = template.FuncMap{
+	"attr": html.EscapeString,
+	"js": func(s string) string {
+		// A JSON string is also a valid JavaScript string literal
+		data, _ := json.Marshal(s)
+		return string(data)
+	},
+}
+
+// snippetTemplate is the template -componentSnippet renders, set up by
+// loadSnippetTemplate.
+var snippetTemplate *template.Template
+
+// SnippetData is what snippet templates are rendered with.
+type SnippetData struct {
+	Source string
+
+	// Dimensions of the largest fallback variant, to reserve its space
+	Width, Height int
+
+	// Fallback format, its smallest variant and every variant of it with
+	// width descriptors
+	Type   string
+	Src    string
+	Srcset string
+
+	// The other formats in -negotiationOrder
+	Sources []SnippetSource
+
+	// The kind of placeholder picked with -snippetPlaceholder, and the
+	// placeholders that were computed for the image
+	Placeholder string
+	LQIP        string
+	BlurHash    string
+	Color       string
+}
+
+type SnippetSource struct {
+	Type   string
+	Srcset string
+}
+
+// loadSnippetTemplate parses the template at path, or the built-in one of flavor
+// if path is empty.
+func loadSnippetTemplate(path, flavor string) error {
+	text, ok := snippetTemplates[flavor]
+	if !ok {
+		return fmt.Errorf("invalid flavor %s, must be html or jsx", flavor)
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read file: %w", err)
+		}
+		text = string(data)
+	}
+
+	t, err := template.New("snippet").Funcs(snippetFuncs).Parse(text)
+	if err != nil {
+		return fmt.Errorf("parse template: %w", err)
+	}
+
+	snippetTemplate = t
+	return nil
+}
+
+// snippetWants returns whether -componentSnippet needs the placeholder kind.
+func snippetWants(kind string) bool {
+	return *componentSnippet && *snippetPlaceholder == kind
+}
+
+// writeComponentSnippets writes <name>.snippet.html or .jsx next to the outputs
+// of every source that produced any in this run.
+func writeComponentSnippets(infos *SourceInfos, outputs []Output) error {
+	bySource := make(map[string][]Output)
+	var order []string
+
+	for _, o := range outputs {
+		if _, ok := bySource[o.Source]; !ok {
+			order = append(order, o.Source)
+		}
+		bySource[o.Source] = append(bySource[o.Source], o)
+	}
+
+	for _, source := range order {
+		base, err := outputBase(source, "")
+		if err != nil {
+			return err
+		}
+		path := base + ".snippet." + *snippetFlavor
+
+		data := snippetData(source, filepath.Dir(path), bySource[source])
+		if info := infos.Get(source); info != nil {
+			data.LQIP, data.BlurHash, data.Color = info.LQIP, info.BlurHash, info.Color
+		}
+
+		var b bytes.Buffer
+		if err := snippetTemplate.Execute(&b, data); err != nil {
+			return fmt.Errorf("render snippet of %s: %w", source, err)
+		}
+		if err := writeOutputFile(path, b.Bytes()); err != nil {
+			return fmt.Errorf("write snippet of %s: %w", source, err)
+		}
+	}
+
+	return nil
+}
+
+// snippetData lists the variants of source in srcsets by format, with URLs
+// relative to dir. Formats rank by -negotiationOrder and the last one is the
+// fallback.
+func snippetData(source, dir string, variants []Output) SnippetData {
+	byFormat := make(map[string][]Output)
+	var formats []string
+	for _, o := range variants {
+		f := normalizeFormat(o.Format)
+		if _, ok := byFormat[f]; !ok {
+			formats = append(formats, f)
+		}
+		byFormat[f] = append(byFormat[f], o)
+	}
+	sort.SliceStable(formats, func(i, j int) bool {
+		return formatRank(formats[i]) < formatRank(formats[j])
+	})
+
+	href := func(o Output) string {
+		rel, err := filepath.Rel(dir, o.Path)
+		if err != nil {
+			rel = o.Path
+		}
+		return (&url.URL{Path: filepath.ToSlash(rel)}).EscapedPath()
+	}
+
+	data := SnippetData{Source: filepath.ToSlash(source), Placeholder: *snippetPlaceholder}
+
+	for i, format := range formats {
+		list := byFormat[format]
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Width < list[j].Width
+		})
+
+		// Only one variant per width can be told apart by the browser
+		var candidates []string
+		described := make(map[int]bool)
+		for _, o := range list {
+			if !described[o.Width] {
+				described[o.Width] = true
+				candidates = append(candidates, fmt.Sprintf("%s %dw", href(o), o.Width))
+			}
+		}
+		srcset := strings.Join(candidates, ", ")
+
+		if i < len(formats)-1 {
+			data.Sources = append(data.Sources, SnippetSource{Type: mimeType(format), Srcset: srcset})
+			continue
+		}
+
+		largest := list[len(list)-1]
+		data.Type, data.Src, data.Srcset = mimeType(format), href(list[0]), srcset
+		data.Width, data.Height = largest.Width, largest.Height
+	}
+
+	return data
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"math"
+)
+
+// standardLuminanceQuant is the luminance quantization table of the JPEG
+// standard in zigzag order, which encoders scale to their quality.
+var standardLuminanceQuant = [64]float64{
+	16, 11, 12, 14, 12, 10, 16, 14,
+	13, 14, 18, 17, 16, 19, 24, 40,
+	26, 24, 22, 22, 24, 49, 35, 37,
+	29, 40, 58, 51, 61, 60, 57, 51,
+	56, 55, 64, 72, 92, 78, 64, 68,
+	87, 69, 55, 56, 80, 109, 81, 87,
+	95, 98, 103, 104, 103, 62, 77, 113,
+	121, 112, 100, 120, 92, 101, 103, 99,
+}
+
+// jpegQuality estimates the quality the JPEG read from r was saved at from its
+// luminance quantization table, assuming it was scaled from the standard one
+// like libjpeg does. It returns false if r doesn't hold a JPEG or its table
+// can't be found.
+func jpegQuality(r io.Reader) (float64, bool) {
+	var table []float64
+	readJPEGSegments(r, func(marker byte, segment []byte) bool {
+		if marker != 0xdb {
+			return true
+		}
+
+		// A DQT segment can hold several tables, each with its precision and id
+		for len(segment) > 0 {
+			precision, id := segment[0]>>4, segment[0]&0xf
+			n := 64
+			if precision == 1 {
+				n = 128
+			}
+			if len(segment) < 1+n {
+				return false
+			}
+
+			if id == 0 {
+				table = make([]float64, 64)
+				for i := range table {
+					if precision == 1 {
+						table[i] = float64(binary.BigEndian.Uint16(segment[1+i*2:]))
+					} else {
+						table[i] = float64(segment[1+i])
+					}
+				}
+				return false
+			}
+			segment = segment[1+n:]
+		}
+		return true
+	})
+	if table == nil {
+		return 0, false
+	}
+
+	// Average scaling factor of the table in percent, as libjpeg computes it from the quality
+	var scale float64
+	for i, v := range table {
+		scale += v * 100 / standardLuminanceQuant[i]
+	}
+	scale /= 64
+
+	var q float64
+	if scale <= 100 {
+		q = (200 - scale) / 2
+	} else {
+		q = 5000 / scale
+	}
+	return math.Max(1, math.Min(100, math.Round(q))), true
+}
+
+// sourceQuality returns the estimated quality of the JPEG at path, or 0 if it
+// isn't a JPEG.
+func sourceQuality(fsys fs.FS, path string) float64 {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	q, _ := jpegQuality(f)
+	return q
+}
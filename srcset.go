@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	srcsetWidth   = "width"
+	srcsetDensity = "density"
+)
+
+// writeSrcset writes an HTML snippet with a <picture> element that picks between
+// the variants of a source, with a <source> per format in -negotiationOrder and
+// the last format as the <img> fallback. Depending on -srcsetMode variants are
+// described by their width, or by their density relative to the smallest variant
+// of all formats, which is also the size the <img> is displayed at.
+func writeSrcset(htmlPath string, variants []plannedVariant, w, h int) error {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	width := func(v plannedVariant) int {
+		vw, _ := v.size.Dimensions(w, h)
+		return vw
+	}
+
+	// The smallest variant is 1x, whatever its format
+	smallest := variants[0]
+	byFormat := make(map[string][]plannedVariant)
+	var formats []string
+	for _, v := range variants {
+		if width(v) < width(smallest) {
+			smallest = v
+		}
+
+		f := normalizeFormat(v.size.Format)
+		if _, ok := byFormat[f]; !ok {
+			formats = append(formats, f)
+		}
+		byFormat[f] = append(byFormat[f], v)
+	}
+	sort.SliceStable(formats, func(i, j int) bool {
+		return formatRank(formats[i]) < formatRank(formats[j])
+	})
+
+	dir := filepath.Dir(htmlPath)
+	href := func(v plannedVariant) string {
+		rel, err := filepath.Rel(dir, v.path)
+		if err != nil {
+			rel = v.path
+		}
+		return (&url.URL{Path: filepath.ToSlash(rel)}).EscapedPath()
+	}
+
+	baseW, baseH := smallest.size.Dimensions(w, h)
+	if baseW <= 0 {
+		return fmt.Errorf("invalid variant width %d", baseW)
+	}
+
+	var b strings.Builder
+	b.WriteString("<picture>\n")
+
+	for i, format := range formats {
+		list := byFormat[format]
+		sort.SliceStable(list, func(i, j int) bool {
+			return width(list[i]) < width(list[j])
+		})
+
+		var candidates []string
+		described := make(map[string]plannedVariant)
+		for _, v := range list {
+			vw, vh := v.size.Dimensions(w, h)
+
+			descriptor := fmt.Sprintf("%dw", vw)
+			if *srcsetMode == srcsetDensity {
+				// Browsers display every candidate at the size of the 1x one
+				if math.Abs(float64(vh)-float64(baseH*vw)/float64(baseW)) > 1 {
+					return fmt.Errorf("size %s of %s doesn't have the aspect ratio of %s, it can't be described by a density", v.size, format, smallest.size)
+				}
+				descriptor = formatDensity(vw, baseW) + "x"
+			}
+			if other, ok := described[descriptor]; ok {
+				return fmt.Errorf("sizes %s and %s of %s both have the srcset descriptor %s", other.size, v.size, format, descriptor)
+			}
+			described[descriptor] = v
+
+			candidates = append(candidates, href(v)+" "+descriptor)
+		}
+		srcset := html.EscapeString(strings.Join(candidates, ", "))
+
+		if i < len(formats)-1 {
+			fmt.Fprintf(&b, "  <source type=\"%s\" srcset=\"%s\">\n", mimeType(format), srcset)
+			continue
+		}
+		fmt.Fprintf(&b, "  <img src=\"%s\" srcset=\"%s\" width=\"%d\" height=\"%d\" alt=\"\">\n", html.EscapeString(href(list[0])), srcset, baseW, baseH)
+	}
+
+	b.WriteString("</picture>\n")
+
+	if err := writeOutputFile(htmlPath, []byte(b.String())); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	ssimWindow = 8
+	ssimStride = 4
+
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// ssim returns the mean structural similarity of the luma of a and b, computed
+// over 8x8 windows every 4 pixels. Both images must have the same dimensions.
+func ssim(a, b image.Image) float64 {
+	la, lb := luma(a), luma(b)
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+
+	// Images smaller than a window are compared as a single window
+	win := ssimWindow
+	if w < win || h < win {
+		win = minInt(w, h)
+	}
+	if win == 0 {
+		return 1
+	}
+
+	var total float64
+	var count int
+
+	for y := 0; y+win <= h; y += ssimStride {
+		for x := 0; x+win <= w; x += ssimStride {
+			var sa, sb, saa, sbb, sab float64
+
+			for wy := y; wy < y+win; wy++ {
+				for wx := x; wx < x+win; wx++ {
+					va, vb := la[wy*w+wx], lb[wy*w+wx]
+
+					sa += va
+					sb += vb
+					saa += va * va
+					sbb += vb * vb
+					sab += va * vb
+				}
+			}
+
+			n := float64(win * win)
+			ma, mb := sa/n, sb/n
+			va, vb := saa/n-ma*ma, sbb/n-mb*mb
+			cov := sab/n - ma*mb
+
+			total += ((2*ma*mb + ssimC1) * (2*cov + ssimC2)) / ((ma*ma + mb*mb + ssimC1) * (va + vb + ssimC2))
+			count++
+		}
+	}
+
+	return total / float64(count)
+}
+
+// luma returns the Rec. 601 luma of every pixel of img, row by row.
+func luma(img image.Image) []float64 {
+	nrgba := imaging.Clone(img)
+	out := make([]float64, len(nrgba.Pix)/4)
+
+	for i := range out {
+		p := nrgba.Pix[i*4 : i*4+3]
+		out[i] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+	}
+
+	return out
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// SVG images are decoded by rasterizing them at their intrinsic size, outputs
+// are rasterized straight at their own size instead with rasterizeForSize.
+func init() {
+	image.RegisterFormat("svg", "<svg", decodeSVG, decodeSVGConfig)
+	image.RegisterFormat("svg", "<?xml", decodeSVG, decodeSVGConfig)
+}
+
+func readSVG(r io.Reader) (*oksvg.SvgIcon, error) {
+	icon, err := oksvg.ReadIconStream(r, oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 {
+		return nil, fmt.Errorf("svg has no viewBox nor width and height")
+	}
+
+	return icon, nil
+}
+
+// svgSize returns the intrinsic size of icon in pixels.
+func svgSize(icon *oksvg.SvgIcon) (int, int) {
+	return maxInt(1, int(math.Ceil(icon.ViewBox.W))), maxInt(1, int(math.Ceil(icon.ViewBox.H)))
+}
+
+func decodeSVG(r io.Reader) (image.Image, error) {
+	icon, err := readSVG(r)
+	if err != nil {
+		return nil, err
+	}
+
+	w, h := svgSize(icon)
+	return rasterizeSVG(icon, w, h), nil
+}
+
+func decodeSVGConfig(r io.Reader) (image.Config, error) {
+	icon, err := readSVG(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	w, h := svgSize(icon)
+	return image.Config{ColorModel: color.NRGBAModel, Width: w, Height: h}, nil
+}
+
+// svgSource is a parsed SVG image, which can be rasterized by several jobs at
+// the same time.
+type svgSource struct {
+	mu   sync.Mutex
+	icon *oksvg.SvgIcon
+}
+
+// loadSVG parses the image at path if it's an SVG file, returning nil otherwise.
+func loadSVG(fsys fs.FS, path string) (*svgSource, error) {
+	if !strings.EqualFold(filepath.Ext(path), ".svg") {
+		return nil, nil
+	}
+
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	icon, err := readSVG(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse svg: %w", err)
+	}
+	return &svgSource{icon: icon}, nil
+}
+
+// rasterizeSVG renders icon stretched to w by h pixels, icon can't be in use
+// by another call at the same time.
+func rasterizeSVG(icon *oksvg.SvgIcon, w, h int) *image.NRGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+
+	return imaging.Clone(img)
+}
+
+// rasterizeForSize renders the image, whose intrinsic size is srcw by srch, at
+// the size resizeToSize needs to make a w by h output of size from it without
+// scaling, so that vector sources stay sharp at any size.
+func (s *svgSource) rasterizeForSize(size Size, srcw, srch, w, h int) image.Image {
+	rw, rh := w, h
+
+	if size.isBox() || size.hasAspect() {
+		sx, sy := float64(w)/float64(srcw), float64(h)/float64(srch)
+
+		var scale float64
+		switch size.mode(srcw, srch) {
+		case modeFill:
+			scale = math.Max(sx, sy)
+		case modePad:
+			scale = math.Min(sx, sy)
+		}
+
+		if scale > 0 {
+			rw = maxInt(1, int(math.Round(float64(srcw)*scale)))
+			rh = maxInt(1, int(math.Round(float64(srch)*scale)))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return rasterizeSVG(s.icon, rw, rh)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throttle is a token bucket that limits how often jobs start, allowing bursts
+// of up to burst jobs after being idle. It is safe for concurrent use.
+type Throttle struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// parseThrottle parses a throttle in the form rate[:burst], where rate is in
+// jobs per second and burst defaults to 1.
+func parseThrottle(s string) (*Throttle, error) {
+	rateStr, burstStr := s, "1"
+	if colon := strings.IndexRune(s, ':'); colon != -1 {
+		rateStr, burstStr = s[:colon], s[colon+1:]
+	}
+
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid rate %s", rateStr)
+	}
+	burst, err := strconv.Atoi(burstStr)
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("invalid burst %s", burstStr)
+	}
+
+	return &Throttle{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}, nil
+}
+
+// Wait blocks until a job is allowed to start.
+func (t *Throttle) Wait() {
+	t.mu.Lock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+
+	// Take the token right away, even if it's not there yet, so that waiting
+	// jobs queue up behind each other
+	t.tokens--
+	wait := time.Duration(-t.tokens / t.rate * float64(time.Second))
+
+	t.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+const dziTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="%s" Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`
+
+// writeTiles writes a Deep Zoom tile pyramid of every file, for use with
+// zoomable image viewers like OpenSeadragon.
+func writeTiles(files []string) error {
+	var g errgroup.Group
+	sem := semaphore.NewWeighted(int64(*parallel))
+
+	for _, f := range files {
+		f := f
+
+		g.Go(func() error {
+			sem.Acquire(context.Background(), 1)
+			defer sem.Release(1)
+
+			return writeImageTiles(f)
+		})
+	}
+
+	return g.Wait()
+}
+
+// writeImageTiles writes <name>.dzi and the tiles of every zoom level to
+// <name>_files/<level>/<column>_<row>.<format>. Level 0 is 1x1 pixels and every
+// level doubles the size of the previous one up to the full image.
+func writeImageTiles(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer in.Close()
+
+	img, err := decodeSource(in, path)
+	if err != nil {
+		return fmt.Errorf("decode image %s: %w", path, err)
+	}
+	img = prepareSource(img)
+
+	base, err := outputBase(path, *tileFormat)
+	if err != nil {
+		return err
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	maxLevel := int(math.Ceil(math.Log2(float64(maxInt(w, h)))))
+
+	// Build the levels from the largest to the smallest so each one is resized
+	// from the previous one
+	level := img
+	for l := maxLevel; l >= 0; l-- {
+		scale := 1 << uint(maxLevel-l)
+		lw, lh := (w+scale-1)/scale, (h+scale-1)/scale
+
+		if level.Bounds().Dx() != lw || level.Bounds().Dy() != lh {
+			level = resize(level, lw, lh)
+		}
+
+		if err := writeLevelTiles(level, fmt.Sprintf("%s_files/%d", base, l)); err != nil {
+			return err
+		}
+	}
+
+	dzi := fmt.Sprintf(dziTemplate, *tileFormat, *tileOverlap, *tileSize, w, h)
+	if err := writeOutputFile(base+".dzi", []byte(dzi)); err != nil {
+		return fmt.Errorf("write descriptor: %w", err)
+	}
+
+	if !*quiet {
+		log.Printf("wrote %d zoom levels of %s", maxLevel+1, path)
+	}
+	return nil
+}
+
+func writeLevelTiles(img image.Image, dir string) error {
+	b := img.Bounds()
+	size, overlap := *tileSize, *tileOverlap
+
+	for row := 0; row*size < b.Dy(); row++ {
+		for col := 0; col*size < b.Dx(); col++ {
+			rect := image.Rect(col*size-overlap, row*size-overlap, (col+1)*size+overlap, (row+1)*size+overlap)
+			tile := imaging.Crop(img, rect.Add(b.Min).Intersect(b))
+
+			tilePath := filepath.Join(dir, fmt.Sprintf("%d_%d.%s", col, row, *tileFormat))
+
+			out, err := outFS.Create(tilePath)
+			if err != nil {
+				return fmt.Errorf("create file %s: %w", tilePath, err)
+			}
+			if err := encode(out, tile, Size{Format: *tileFormat}, *quality); err != nil {
+				out.Close()
+				return fmt.Errorf("encode file %s: %w", tilePath, err)
+			}
+			if err := out.Close(); err != nil {
+				return fmt.Errorf("write file %s: %w", tilePath, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
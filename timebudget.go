@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimeBudget tracks whether a run is on course to finish within -timeBudget,
+// projecting its total duration from how long the outputs settled so far took.
+// Once the projection goes over the budget it stays over, so that formats
+// aren't switched back and forth. It is safe for concurrent use.
+type TimeBudget struct {
+	mu       sync.Mutex
+	start    time.Time
+	budget   time.Duration
+	expected int
+	settled  int
+	over     bool
+
+	// Formats to encode instead of each format once over budget
+	ladder map[string]string
+}
+
+// timeBudget is set with -timeBudget.
+var timeBudget *TimeBudget
+
+// newTimeBudget creates a budget for a run expected to produce expected outputs,
+// with a ladder in the form from=to,... like webp=jpg,png=jpg.
+func newTimeBudget(budget time.Duration, expected int, ladder string) (*TimeBudget, error) {
+	b := &TimeBudget{
+		start:    time.Now(),
+		budget:   budget,
+		expected: expected,
+		ladder:   make(map[string]string),
+	}
+
+	for _, entry := range strings.Split(ladder, ",") {
+		eq := strings.IndexRune(entry, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("invalid downgrade %s, expected format=format", entry)
+		}
+		b.ladder[normalizeFormat(entry[:eq])] = entry[eq+1:]
+	}
+
+	return b, nil
+}
+
+// Settle records that an output was written or found up to date.
+func (b *TimeBudget) Settle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.settled++
+}
+
+// Downgrade returns the format to encode an output in instead of format, and
+// whether it differs, which happens once the run is projected to take longer
+// than the budget.
+func (b *TimeBudget) Downgrade(format string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.over {
+		elapsed := time.Since(b.start)
+		projected := elapsed
+		if b.settled > 0 && b.settled < b.expected {
+			projected = elapsed * time.Duration(b.expected) / time.Duration(b.settled)
+		}
+
+		if projected > b.budget {
+			b.over = true
+			log.Printf("warning: the run is projected to take %s, over the time budget of %s, downgrading formats from now on", projected.Round(time.Millisecond), b.budget)
+		}
+	}
+
+	to, ok := b.ladder[normalizeFormat(format)]
+	if !b.over || !ok {
+		return format, false
+	}
+	return to, true
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"image"
+	"path/filepath"
+	"testing"
+)
+
+func TestFailedDowngradeUnblocksWaitingJobs(t *testing.T) {
+	defer func(b *TimeBudget) { timeBudget = b }(timeBudget)
+	timeBudget = &TimeBudget{over: true, ladder: map[string]string{"webp": "jpg"}}
+
+	// The source is outside the source root, so its downgraded output can't be placed
+	dir := t.TempDir()
+	withSourceRoots(t, filepath.Join(dir, "out"), filepath.Join(dir, "root"))
+
+	job := &Job{
+		img:      image.NewNRGBA(image.Rect(0, 0, 4, 4)),
+		size:     Size{Height: 2, Format: "webp"},
+		outPath:  filepath.Join(dir, "out", "photo-2p.webp"),
+		origPath: filepath.Join(dir, "elsewhere", "photo.jpg"),
+		done:     make(chan struct{}),
+		measured: make(chan struct{}),
+	}
+	if err := doJob(job); err == nil {
+		t.Fatal("expected the job to fail")
+	}
+
+	for name, ch := range map[string]chan struct{}{"done": job.done, "measured": job.measured} {
+		select {
+		case <-ch:
+		default:
+			t.Errorf("%s wasn't closed, jobs waiting on it would block forever", name)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"sync"
+)
+
+// recoveredImages holds the paths of the images -tolerant recovered, which are
+// marked as such in the manifest.
+var recoveredImages sync.Map
+
+func wasRecovered(path string) bool {
+	_, ok := recoveredImages.Load(path)
+	return ok
+}
+
+// padTruncatedJPEG returns data with the image data of a truncated JPEG padded
+// with zeros, so that decoders can fill in the blocks that are missing instead
+// of failing. It returns false if data doesn't hold a JPEG or its header is
+// damaged too.
+func padTruncatedJPEG(data []byte) ([]byte, bool) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "jpeg" {
+		return nil, false
+	}
+
+	// The end of image marker would stop the decoder before the padding
+	data = bytes.TrimSuffix(data, []byte{0xff, 0xd9})
+
+	// Zero bits decode as the shortest Huffman codes, a couple of bytes per pixel
+	// are enough to fill in every block that is missing
+	padded := make([]byte, len(data), len(data)+cfg.Width*cfg.Height*2+2)
+	copy(padded, data)
+	padded = padded[:cap(padded)-2]
+	return append(padded, 0xff, 0xd9), true
+}
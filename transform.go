@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// prepareSource applies the transformations shared by all sizes of a source
+// image, the pipeline steps before resizing, so they only run once right after
+// decoding it.
+func prepareSource(img image.Image) image.Image {
+	for _, s := range sourceSteps() {
+		img = s.apply(img, nil)
+	}
+	return img
+}
+
+// transformsSource returns whether prepareSource changes images.
+func transformsSource() bool {
+	for _, s := range sourceSteps() {
+		if s.setting(nil) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// trimTransparentPadding crops img to the bounding box of its non transparent
+// pixels, leaving padding pixels of margin around it where possible.
+func trimTransparentPadding(img image.Image, padding int) image.Image {
+	b := img.Bounds()
+	box := image.Rectangle{}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if alphaAt(img, x, y) == 0 {
+				continue
+			}
+
+			if box.Empty() {
+				box = image.Rect(x, y, x+1, y+1)
+			} else {
+				box = box.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+
+	// Leave fully transparent images untouched
+	if box.Empty() {
+		return img
+	}
+
+	box = box.Inset(-padding).Intersect(b)
+	if box == b {
+		return img
+	}
+
+	return imaging.Crop(img, box)
+}
+
+func alphaAt(img image.Image, x, y int) uint8 {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return img.Pix[img.PixOffset(x, y)+3]
+	case *image.RGBA:
+		return img.Pix[img.PixOffset(x, y)+3]
+	case *image.YCbCr, *image.Gray:
+		return 0xff
+	}
+
+	_, _, _, a := img.At(x, y).RGBA()
+	return uint8(a >> 8)
+}
+
+// checkPosterize returns an error if levels isn't a valid number of levels per
+// channel for posterize, or 0 to disable it.
+func checkPosterize(levels int) error {
+	if levels != 0 && (levels < 2 || levels > 256) {
+		return fmt.Errorf("levels must be between 2 and 256, or 0 to disable it")
+	}
+	return nil
+}
+
+// posterize reduces every color channel of img to the given number of evenly
+// spaced levels, keeping alpha as is.
+func posterize(img image.Image, levels int) *image.NRGBA {
+	var table [256]uint8
+	step := 255 / float64(levels-1)
+	for v := range table {
+		table[v] = uint8(math.Round(math.Round(float64(v)/step) * step))
+	}
+
+	dst := imaging.Clone(img)
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		dst.Pix[i] = table[dst.Pix[i]]
+		dst.Pix[i+1] = table[dst.Pix[i+1]]
+		dst.Pix[i+2] = table[dst.Pix[i+2]]
+	}
+
+	return dst
+}
+
+// linkResizeChain orders jobs from largest to smallest and makes each one
+// resize from the output of the smallest job that is still at least as large,
+// instead of from the original image.
+func linkResizeChain(jobs []*Job) {
+	sortLargestFirst(jobs)
+
+	for i, job := range jobs {
+		job.done = make(chan struct{})
+
+		// Cropped or padded outputs can't be resized from, nor resized from others
+		if !job.size.keepsAspect() {
+			continue
+		}
+
+		w, h := job.dimensions()
+		for j := i - 1; j >= 0; j-- {
+			if !jobs[j].size.keepsAspect() {
+				continue
+			}
+			pw, ph := jobs[j].dimensions()
+
+			if pw >= w && ph >= h {
+				job.parent = jobs[j]
+				break
+			}
+		}
+	}
+}
+
+// sortLargestFirst sorts jobs by the area of their output in descending order,
+// keeping the order of jobs of the same area.
+func sortLargestFirst(jobs []*Job) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		wi, hi := jobs[i].dimensions()
+		wj, hj := jobs[j].dimensions()
+		return wi*hi > wj*hj
+	})
+}
+
+// denoise reduces noise in img, using a gaussian blur with the given sigma or a
+// median filter with a window radius of strength rounded to pixels.
+func denoise(img image.Image, filter string, strength float64) image.Image {
+	if filter == "median" {
+		return medianFilter(img, int(math.Round(strength)))
+	}
+
+	return imaging.Blur(img, strength)
+}
+
+// medianFilter replaces every pixel with the per-channel median of the square
+// window of the given radius around it. Each row keeps a histogram of the window
+// per channel that slides along it, along with the median and how many values
+// are below it, which only move a little from one pixel to the next. The cost
+// per pixel grows with the radius rather than with the area of the window.
+func medianFilter(img image.Image, radius int) *image.NRGBA {
+	src := imaging.Clone(img)
+	if radius < 1 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	var hist [4][256]int
+	var med [4]int
+	var below [4]int
+	for y := 0; y < h; y++ {
+		y0, y1 := maxInt(y-radius, 0), minInt(y+radius, h-1)
+		rows := y1 - y0 + 1
+
+		column := func(x, delta int) {
+			for wy := y0; wy <= y1; wy++ {
+				i := wy*src.Stride + x*4
+				for c := 0; c < 4; c++ {
+					v := int(src.Pix[i+c])
+					hist[c][v] += delta
+					if v < med[c] {
+						below[c] += delta
+					}
+				}
+			}
+		}
+
+		hist, med, below = [4][256]int{}, [4]int{}, [4]int{}
+		for x := 0; x <= minInt(radius, w-1); x++ {
+			column(x, 1)
+		}
+
+		for x := 0; x < w; x++ {
+			if x > 0 {
+				if out := x - radius - 1; out >= 0 {
+					column(out, -1)
+				}
+				if in := x + radius; in < w {
+					column(in, 1)
+				}
+			}
+
+			// The median is the middle value of the window sorted, so at most
+			// half of the values are below it and more than half up to it
+			half := rows * (minInt(x+radius, w-1) - maxInt(x-radius, 0) + 1) / 2
+			for c := 0; c < 4; c++ {
+				for below[c] > half {
+					med[c]--
+					below[c] -= hist[c][med[c]]
+				}
+				for below[c]+hist[c][med[c]] <= half {
+					below[c] += hist[c][med[c]]
+					med[c]++
+				}
+				dst.Pix[y*dst.Stride+x*4+c] = uint8(med[c])
+			}
+		}
+	}
+
+	return dst
+}
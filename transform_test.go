@@ -0,0 +1,36 @@
+package main
+
+import (
+	"image"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestMedianFilterMatchesSortedWindow(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 23, 17))
+	rng.Read(img.Pix)
+
+	for _, radius := range []int{1, 2, 5, 30} {
+		got := medianFilter(img, radius)
+
+		for y := 0; y < 17; y++ {
+			for x := 0; x < 23; x++ {
+				for c := 0; c < 4; c++ {
+					var window []int
+					for wy := maxInt(y-radius, 0); wy <= minInt(y+radius, 16); wy++ {
+						for wx := maxInt(x-radius, 0); wx <= minInt(x+radius, 22); wx++ {
+							window = append(window, int(img.Pix[wy*img.Stride+wx*4+c]))
+						}
+					}
+					sort.Ints(window)
+
+					if v := int(got.Pix[y*got.Stride+x*4+c]); v != window[len(window)/2] {
+						t.Fatalf("radius %d: channel %d of (%d, %d) is %d, expected %d", radius, c, x, y, v, window[len(window)/2])
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// looksLikeUI returns whether img has at most -uiMaxColors colors, as screenshots
+// of user interfaces and diagrams usually do while photos don't.
+func looksLikeUI(img image.Image) bool {
+	b := img.Bounds()
+	colors := make(map[color.RGBA]struct{})
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			colors[color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)] = struct{}{}
+
+			if len(colors) > *uiMaxColors {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// uiSizes returns sizes routed to lossless outputs: webp is encoded losslessly,
+// and jpeg is replaced by png, which is reduced to a palette like png outputs.
+// Sizes that end up the same once routed are only returned once.
+func uiSizes(sizes []Size) []Size {
+	var routed []Size
+	seen := make(map[Size]bool)
+
+	for _, s := range sizes {
+		switch normalizeFormat(s.Format) {
+		case "webp":
+			s.Lossless = true
+		case "jpeg":
+			s.Format = "png"
+			s.Quantize = true
+		case "png":
+			s.Quantize = true
+		}
+
+		if !seen[s] {
+			seen[s] = true
+			routed = append(routed, s)
+		}
+	}
+
+	return routed
+}
+
+// quantizeColors is the size of the palette of quantized images.
+const quantizeColors = 256
+
+// quantize reduces img to a palette of its most common colors, mapping the rest
+// to the closest one. This keeps the flat areas of UI images exact, while the
+// colors that resampling blends at their edges are approximated.
+func quantize(img image.Image) *image.Paletted {
+	b := img.Bounds()
+	counts := make(map[color.RGBA]int)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			counts[color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)]++
+		}
+	}
+
+	palette := make(color.Palette, 0, len(counts))
+	for c := range counts {
+		palette = append(palette, c)
+	}
+	sort.Slice(palette, func(i, j int) bool {
+		ci, cj := palette[i].(color.RGBA), palette[j].(color.RGBA)
+		if counts[ci] != counts[cj] {
+			return counts[ci] > counts[cj]
+		}
+		// Break ties by value so the palette doesn't depend on map order
+		return rgbaKey(ci) < rgbaKey(cj)
+	})
+	if len(palette) > quantizeColors {
+		palette = palette[:quantizeColors]
+	}
+
+	dst := image.NewPaletted(b, palette)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+	return dst
+}
+
+func rgbaKey(c color.RGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "log"
+
+// printSizeUsage logs how many of the images each configured size was produced
+// for in this run, to spot sizes that are rarely or never used.
+func printSizeUsage(outputs []Output, sizes []Size, images int) {
+	counts := make(map[Size]int)
+	for _, o := range outputs {
+		counts[o.Size]++
+	}
+
+	for _, s := range sizes {
+		label := s.String() + "-" + s.Format
+
+		if n := counts[s]; n > 0 {
+			log.Printf("size %s: produced for %d of %d images", label, n, images)
+		} else {
+			log.Printf("size %s: never produced", label)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"strings"
+)
+
+// validateInput checks that the header of the image at path can be decoded and
+// that it passes -allowTypes and -maxPixels.
+func validateInput(fsys fs.FS, path string) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("decode image config: %w", err)
+	}
+
+	if *allowTypes != "" {
+		allowed := false
+		for _, t := range strings.Split(*allowTypes, ",") {
+			allowed = allowed || normalizeFormat(t) == normalizeFormat(format)
+		}
+
+		if !allowed {
+			return fmt.Errorf("image type %s is not allowed", format)
+		}
+	}
+
+	if *maxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > *maxPixels {
+		return fmt.Errorf("image is %dx%d, more than %d pixels", cfg.Width, cfg.Height, *maxPixels)
+	}
+
+	return nil
+}
+
+// validateInputs validates every file and returns the number that failed,
+// logging the reason of each.
+func validateInputs(fsys fs.FS, files []string) int {
+	failed := 0
+
+	for _, f := range files {
+		if err := validateInput(fsys, f); err != nil {
+			log.Printf("invalid image %s: %s", f, err)
+			failed++
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"os"
+)
+
+// verifyTolerance is the number of pixels a dimension may be off by to allow for rounding.
+const verifyTolerance = 1
+
+// verifyOutputs checks that the dimensions of every output match the ones
+// implied by its size and the dimensions of its source, returning the number
+// of mismatches.
+func verifyOutputs(infos *SourceInfos, outputs []Output) (int, error) {
+	mismatches := 0
+
+	for _, o := range outputs {
+		info := infos.Get(o.Source)
+		if info == nil {
+			continue
+		}
+
+		cfg, err := decodeOutputConfig(o.Path)
+		if err != nil {
+			return mismatches, err
+		}
+
+		w, h := o.Size.Dimensions(info.Width, info.Height)
+		if abs(cfg.Width-w) > verifyTolerance || abs(cfg.Height-h) > verifyTolerance {
+			log.Printf("output %s is %dx%d but %dx%d was expected", o.Path, cfg.Width, cfg.Height, w, h)
+			mismatches++
+		}
+	}
+
+	return mismatches, nil
+}
+
+func decodeOutputConfig(path string) (image.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("open file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("decode image config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}